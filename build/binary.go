@@ -0,0 +1,107 @@
+package build
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// elfArchs maps the ELF machines to the architectures the images are built for.
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_386:     "386",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+}
+
+// ValidateBinary function checks that the prebuilt binary can be debugged by dlv once packaged: it must be a linux
+// binary of the architecture, with its symbol table and DWARF information, which `-ldflags "-s -w"` strips.
+func ValidateBinary(path, arch string) error {
+	if arch == "" {
+		arch = DefaultArch
+	}
+	file, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s isn't a linux binary: %v", path, err)
+	}
+	defer file.Close()
+
+	binaryArch, ok := elfArchs[file.Machine]
+	if !ok {
+		binaryArch = file.Machine.String()
+	}
+	if binaryArch != arch {
+		return fmt.Errorf("%s is built for %s, not %s", path, binaryArch, arch)
+	}
+	if file.Section(".symtab") == nil {
+		return fmt.Errorf("%s has no symbol table, it was stripped with -s. Please build it without "+
+			"-ldflags \"-s -w\"", path)
+	}
+	if file.Section(".debug_info") == nil && file.Section(".zdebug_info") == nil {
+		return fmt.Errorf("%s has no DWARF information, it was stripped with -w. Please build it without "+
+			"-ldflags \"-s -w\"", path)
+	}
+	if _, err = file.DWARF(); err != nil {
+		return fmt.Errorf("cannot read the DWARF information of %s: %v", path, err)
+	}
+	return nil
+}
+
+// CompileBinary function puts the debugged binary of the image kind into the directory, a debug build of it or the
+// prebuilt binary of the options, and returns its path. Nothing else of the image is built.
+func CompileBinary(opts Options, dir string) (string, error) {
+	if opts.Arch == "" {
+		opts.Arch = DefaultArch
+	}
+	sourcePath, err := filepath.Abs(opts.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	opts.SourcePath = sourcePath
+
+	binaries, _ := imageContent(opts.Image)
+	if len(binaries) == 0 {
+		return "", fmt.Errorf("the %s image has no Trident binary", opts.Image)
+	}
+	if err = mainBinary(opts, binaries[0], linkerFlags(opts.SourcePath), dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, binaries[0].name), nil
+}
+
+// mainBinary function puts the debugged binary of the image into the build context: the prebuilt binary of the
+// options if any, otherwise a debug build of it.
+func mainBinary(opts Options, bin binary, ldflags, contextDir string) error {
+	if opts.Binary == "" {
+		return compile(opts, bin, ldflags, contextDir)
+	}
+
+	fmt.Printf("Packaging the prebuilt %s %s...\n", bin.name, opts.Binary)
+	if err := ValidateBinary(opts.Binary, opts.Arch); err != nil {
+		return err
+	}
+	return copyFile(opts.Binary, filepath.Join(contextDir, bin.name), 0755)
+}
+
+// copyFile function copies the file to the destination with the given permissions.
+func copyFile(source, destination string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
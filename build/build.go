@@ -0,0 +1,306 @@
+package build
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// ImageTrident is the debug image of trident_orchestrator, used for the controller and the node plugin.
+	ImageTrident = "trident"
+	// ImageOperator is the debug image of trident-operator.
+	ImageOperator = "operator"
+	// ImageDlv is the image of dlv alone, attached to a running Trident from an ephemeral container.
+	ImageDlv = "dlv"
+
+	DefaultArch = "amd64"
+
+	tridentConfigPkg  = "github.com/netapp/trident/config"
+	operatorConfigPkg = "github.com/netapp/trident/operator/config"
+	// defaultRegistry is the registry of the released Trident images, the ones the binaries install by default.
+	defaultRegistry = "docker.io/netapp"
+	// versionFile holds the Trident version, in the source tree.
+	versionFile  = "hack/VERSION"
+	buildType    = "custom"
+	buildTypeRev = "0"
+
+	dockerCLI = "docker"
+
+	// debugGCFlags disables the optimizations and the inlining, which get in the way of dlv.
+	debugGCFlags = "-gcflags=all=-N -l"
+)
+
+//go:embed Dockerfile.tmpl Dockerfile.operator.tmpl Dockerfile.dlv.tmpl
+var dockerfiles embed.FS
+
+// Options describes a debug image build.
+type Options struct {
+	// SourcePath is the Trident source tree the binaries are compiled from. It is only ever read.
+	SourcePath string
+	// Image is the kind of image built, one of ImageTrident, ImageOperator or ImageDlv.
+	Image string
+	// Arch is the architecture the binaries and the image are built for.
+	Arch string
+	// Reference is the image reference the image is tagged with and pushed to.
+	Reference string
+	// DlvPort is the port dlv listens on in the image.
+	DlvPort int
+	// LoadInto is the tool of the local cluster, one of LoadKind, LoadMinikube or LoadK3d, the image is
+	// side-loaded into instead of being pushed.
+	LoadInto string
+	// Cluster is the name of the local cluster the image is loaded into.
+	Cluster string
+	// BaseImage is the image Layer appends the debug binaries to, the one the target runs in the cluster.
+	BaseImage string
+	// Binary is a prebuilt debugged binary packaged instead of compiling one, see ValidateBinary.
+	Binary string
+	// NoCache rebuilds the image even if the image cache holds one of the same content.
+	NoCache bool
+	// Insecure lets Layer read and push images over plain HTTP or with unverified certificates.
+	Insecure bool
+	// DlvVersion is the version of dlv installed in the image. The latest one is resolved when it is empty, before
+	// the image cache is looked up, so that a new dlv release gets a new image.
+	DlvVersion string
+}
+
+// binary is a Trident binary of a debug image.
+type binary struct {
+	name    string
+	pkg     string
+	tarball bool
+}
+
+// dockerfileData holds the values the Dockerfile templates are rendered with.
+type dockerfileData struct {
+	Arch       string
+	DlvPort    int
+	DlvVersion string
+}
+
+// Build function compiles the Trident binaries of the image without optimizations and inlining, so that dlv can
+// debug them, renders the Dockerfile of the image into a temporary build context with the binaries, then builds
+// and pushes the image. Everything is written to the temporary context, the Trident source tree is left untouched.
+// It returns the reference of the pushed image pinned by digest, e.g. `ghcr.io/me/trident-debug@sha256:...`.
+// An image loaded into a local cluster isn't pushed, and keeps its reference.
+func Build(opts Options) (string, error) {
+	if opts.Arch == "" {
+		opts.Arch = DefaultArch
+	}
+	sourcePath, err := filepath.Abs(opts.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	opts.SourcePath = sourcePath
+	if err = resolveDlvVersion(&opts); err != nil {
+		return "", err
+	}
+
+	binaries, dockerfile := imageContent(opts.Image)
+
+	// Images loaded into a local cluster aren't in a registry, so they aren't cached.
+	var hash string
+	if opts.LoadInto == "" {
+		dockerfileTemplate, err := dockerfiles.ReadFile(dockerfile)
+		if err != nil {
+			return "", err
+		}
+		if hash, err = contentHash(opts, dockerfileTemplate); err != nil {
+			return "", err
+		}
+		if !opts.NoCache {
+			if cached := cachedImage(hash, false); cached != "" {
+				fmt.Println("Reusing the cached image", cached)
+				return cached, nil
+			}
+		}
+	}
+
+	contextDir, err := os.MkdirTemp("", "trident-debug-build-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create the build context: %v", err)
+	}
+	defer os.RemoveAll(contextDir)
+
+	ldflags := linkerFlags(opts.SourcePath)
+	for i, bin := range binaries {
+		if i == 0 {
+			err = mainBinary(opts, bin, ldflags, contextDir)
+		} else {
+			err = compile(opts, bin, ldflags, contextDir)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err = renderDockerfile(dockerfile, dockerfileData{Arch: opts.Arch, DlvPort: opts.DlvPort,
+		DlvVersion: opts.DlvVersion}, filepath.Join(contextDir, "Dockerfile")); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Building the image %s...\n", opts.Reference)
+	if err = run(contextDir, nil, dockerCLI, "build", "--platform", "linux/"+opts.Arch, "--tag", opts.Reference,
+		"--rm", "."); err != nil {
+		return "", fmt.Errorf("cannot build the image %s: %v", opts.Reference, err)
+	}
+
+	if opts.LoadInto != "" {
+		return opts.Reference, LoadImage(opts.LoadInto, opts.Cluster, opts.Reference)
+	}
+
+	fmt.Printf("Pushing the image %s...\n", opts.Reference)
+	if err = run(contextDir, nil, dockerCLI, "push", opts.Reference); err != nil {
+		return "", fmt.Errorf("cannot push the image %s: %v", opts.Reference, err)
+	}
+
+	image, err := pushedDigestReference(opts.Reference)
+	if err != nil {
+		return "", err
+	}
+	cacheImage(hash, image)
+	return image, nil
+}
+
+// pushedDigestReference function returns the pushed image reference pinned by its digest, which the registry
+// reported on push.
+func pushedDigestReference(reference string) (string, error) {
+	out, err := exec.Command(dockerCLI, "image", "inspect", "--format",
+		"{{range .RepoDigests}}{{println .}}{{end}}", reference).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot find the digest of the image %s: %v", reference, err)
+	}
+
+	// Docker lists the images of Docker Hub without their registry.
+	repository := strings.TrimPrefix(Repository(reference), "docker.io/")
+	for _, repoDigest := range strings.Fields(string(out)) {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			return Repository(reference) + repoDigest[len(repository):], nil
+		}
+	}
+	return "", fmt.Errorf("cannot find the digest of the image %s among %s", reference,
+		strings.Join(strings.Fields(string(out)), ", "))
+}
+
+// imageContent function returns the binaries and the Dockerfile template of the image.
+func imageContent(image string) ([]binary, string) {
+	switch image {
+	case ImageOperator:
+		return []binary{{name: "trident-operator", pkg: "./operator"}}, "Dockerfile.operator.tmpl"
+	case ImageDlv:
+		return nil, "Dockerfile.dlv.tmpl"
+	}
+	return []binary{
+		{name: "trident_orchestrator", pkg: "."},
+		{name: "tridentctl", pkg: "./cli"},
+		{name: "chwrap", pkg: "./chwrap", tarball: true},
+	}, "Dockerfile.tmpl"
+}
+
+// linkerFlags function returns the linker flags of Trident's debug builds, the ones of its Makefile. Unlike
+// release builds, the symbol table and the DWARF information are kept, dlv needs them.
+func linkerFlags(sourcePath string) string {
+	buildHash := "unknown"
+	if hash, dirty := gitHash(sourcePath); hash != "" {
+		buildHash = hash
+		if dirty {
+			buildHash += "-dirty"
+		}
+	}
+
+	variables := []string{
+		tridentConfigPkg + ".BuildHash=" + buildHash,
+		tridentConfigPkg + ".BuildType=" + buildType,
+		tridentConfigPkg + ".BuildTypeRev=" + buildTypeRev,
+		tridentConfigPkg + ".BuildTime=" + time.Now().Format(time.UnixDate),
+	}
+	variables = append(variables, imageVariables(sourcePath)...)
+	flags := make([]string, 0, len(variables))
+	for _, variable := range variables {
+		flags = append(flags, fmt.Sprintf("-X '%s'", variable))
+	}
+	return strings.Join(flags, " ")
+}
+
+// imageVariables function returns the linker variables of the images the binaries install by default: the
+// Trident and operator images of the version of the source tree, and the optional autosupport and ACP images.
+// As with the Makefile, the environment variables TRIDENT_TAG, OPERATOR_TAG, DEFAULT_AUTOSUPPORT_IMAGE and
+// DEFAULT_ACP_IMAGE override them. Without a version, the defaults compiled into the binaries are kept.
+func imageVariables(sourcePath string) []string {
+	var version string
+	if content, err := os.ReadFile(filepath.Join(sourcePath, versionFile)); err == nil {
+		version = strings.TrimSpace(string(content))
+	}
+
+	var variables []string
+	for _, image := range []struct{ variable, environment, name string }{
+		{tridentConfigPkg + ".BuildImage", "TRIDENT_TAG", "trident"},
+		{operatorConfigPkg + ".BuildImage", "OPERATOR_TAG", "trident-operator"},
+	} {
+		tag := os.Getenv(image.environment)
+		if tag == "" && version != "" {
+			tag = defaultRegistry + "/" + image.name + ":" + version
+		}
+		if tag != "" {
+			variables = append(variables, image.variable+"="+tag)
+		}
+	}
+	if image := os.Getenv("DEFAULT_AUTOSUPPORT_IMAGE"); image != "" {
+		variables = append(variables, tridentConfigPkg+".DefaultAutosupportImage="+image)
+	}
+	if image := os.Getenv("DEFAULT_ACP_IMAGE"); image != "" {
+		variables = append(variables, tridentConfigPkg+".DefaultACPImage="+image)
+	}
+	return variables
+}
+
+// compile function builds the binary for linux into the build context, packing it the way the image expects.
+func compile(opts Options, bin binary, ldflags, contextDir string) error {
+	fmt.Printf("Compiling %s for linux/%s...\n", bin.name, opts.Arch)
+	output := filepath.Join(contextDir, bin.name)
+	env := []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=" + opts.Arch}
+	// With -trimpath the sources are recorded by module path, whatever the location of the Trident checkout.
+	if err := run(opts.SourcePath, env, "go", "build", "-o", output, "-trimpath", "-ldflags", ldflags,
+		debugGCFlags, bin.pkg); err != nil {
+		return fmt.Errorf("cannot compile %s: %v", bin.name, err)
+	}
+
+	if bin.tarball {
+		// Trident's own script lays chwrap out with the links to the host tools it wraps.
+		script := filepath.Join(opts.SourcePath, "chwrap", "make-tarball.sh")
+		if err := run(contextDir, nil, "sh", script, output, output+".tar"); err != nil {
+			return fmt.Errorf("cannot pack %s: %v", bin.name, err)
+		}
+		return os.Remove(output)
+	}
+	return nil
+}
+
+// renderDockerfile function renders the embedded Dockerfile template to the path.
+func renderDockerfile(name string, data dockerfileData, path string) error {
+	tmpl, err := template.ParseFS(dockerfiles, name)
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if err = tmpl.Execute(&content, data); err != nil {
+		return fmt.Errorf("cannot render %s: %v", name, err)
+	}
+	return os.WriteFile(path, content.Bytes(), 0644)
+}
+
+// run function runs the command in the directory with the additional environment, streaming its output.
+func run(dir string, env []string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
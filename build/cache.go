@@ -0,0 +1,184 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	cacheDirName   = "trident-debug"
+	cacheIndexName = "image-cache.json"
+)
+
+// cacheEntry is an image of the cache index, pushed for a content hash.
+type cacheEntry struct {
+	Image   string    `json:"image"`
+	Created time.Time `json:"created"`
+}
+
+// contentHash function returns a hash of everything the debug image is made of: the Trident source tree, as its
+// git tree plus the content of its uncommitted files, the prebuilt binary if any, the build flags, the Dockerfile
+// template and the repository the image is pushed to. The base is what the image is assembled on, the Dockerfile
+// template or the digest of the base image of Layer. It returns an empty hash, disabling the cache, when the tree
+// isn't a git checkout.
+func contentHash(opts Options, base []byte) (string, error) {
+	tree, err := exec.Command("git", "-C", opts.SourcePath, "rev-parse", "HEAD:./").Output()
+	if err != nil {
+		return "", nil
+	}
+	// The files differing from HEAD, staged or not, and the untracked ones, all relative to the source tree.
+	changed, err := exec.Command("git", "-C", opts.SourcePath, "diff", "--name-only", "-z", "--relative",
+		"HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot list the uncommitted files of %s: %v", opts.SourcePath, err)
+	}
+	untracked, err := exec.Command("git", "-C", opts.SourcePath, "ls-files", "-z", "--others",
+		"--exclude-standard").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot list the untracked files of %s: %v", opts.SourcePath, err)
+	}
+	dirty := append(changed, untracked...)
+
+	digest := sha256.New()
+	for _, field := range []string{string(bytes.TrimSpace(tree)), opts.Image, opts.Arch, fmt.Sprint(opts.DlvPort),
+		Repository(opts.Reference), buildType, buildTypeRev, debugGCFlags, dlvPackage + "@" + opts.DlvVersion} {
+		fmt.Fprintf(digest, "%s\n", field)
+	}
+	for _, variable := range imageVariables(opts.SourcePath) {
+		fmt.Fprintf(digest, "%s\n", variable)
+	}
+	digest.Write(base)
+
+	for _, file := range bytes.Split(dirty, []byte{0}) {
+		if len(file) == 0 {
+			continue
+		}
+		fmt.Fprintf(digest, "%s\n", file)
+		// Deleted files are listed too, their name is enough.
+		_ = hashFile(digest, filepath.Join(opts.SourcePath, string(file)))
+	}
+	if opts.Binary != "" {
+		if err = hashFile(digest, opts.Binary); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// hashFile function writes the content of the file to the hash.
+func hashFile(digest hash.Hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(digest, file)
+	return err
+}
+
+// cachedImage function returns the image pushed for the content hash, if it is still in its registry.
+func cachedImage(contentHash string, insecure bool) string {
+	if contentHash == "" {
+		return ""
+	}
+	index, err := readCacheIndex()
+	if err != nil {
+		fmt.Println("Cannot read the image cache:", err)
+		return ""
+	}
+	entry, ok := index[contentHash]
+	if !ok {
+		return ""
+	}
+
+	var nameOptions []name.Option
+	if insecure {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	reference, err := name.ParseReference(entry.Image, nameOptions...)
+	if err == nil {
+		_, err = remote.Head(reference, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	}
+	if err != nil {
+		fmt.Printf("The cached image %s is gone, rebuilding it: %v\n", entry.Image, err)
+		return ""
+	}
+	return entry.Image
+}
+
+// cacheImage function records the image pushed for the content hash in the cache index.
+func cacheImage(contentHash, image string) {
+	if contentHash == "" {
+		return
+	}
+	index, err := readCacheIndex()
+	if err == nil {
+		index[contentHash] = cacheEntry{Image: image, Created: time.Now()}
+		err = writeCacheIndex(index)
+	}
+	if err != nil {
+		fmt.Println("Cannot record the image in the image cache:", err)
+	}
+}
+
+// cacheIndexPath function returns the path of the cache index, in the user's cache directory.
+func cacheIndexPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, cacheDirName, cacheIndexName), nil
+}
+
+// readCacheIndex function reads the cache index, which is empty when it doesn't exist yet.
+func readCacheIndex() (map[string]cacheEntry, error) {
+	index := make(map[string]cacheEntry)
+	path, err := cacheIndexPath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("invalid cache index %s: %v", path, err)
+	}
+	return index, nil
+}
+
+// writeCacheIndex function replaces the cache index.
+func writeCacheIndex(index map[string]cacheEntry) error {
+	path, err := cacheIndexPath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err = os.WriteFile(temporary, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
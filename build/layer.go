@@ -0,0 +1,300 @@
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	dlvModule  = "github.com/go-delve/delve"
+	dlvPackage = dlvModule + "/cmd/dlv"
+	dlvName    = "dlv"
+
+	layerHistory    = "trident-debug: debug build of %s, dlv and busybox"
+	dlvLayerHistory = "trident-debug: dlv and busybox"
+
+	// busyboxPath is where busybox is in its image and in the debug image, the Dockerfiles copy it there too.
+	busyboxPath = "bin/busybox"
+)
+
+var (
+	// busyboxImage is the image busybox is taken from, as in the Dockerfiles. trident-debug runs it in the debug
+	// pod to copy files in and out, such as core dumps and reloaded binaries.
+	busyboxImage = "busybox:musl"
+
+	// dlvCompiler compiles the version of dlv into a directory, replaced by the tests, which can't download dlv.
+	dlvCompiler = compileDlv
+)
+
+// Layer function assembles the debug image without docker: the image the target runs in the cluster is read from
+// its registry, a layer with the debug build of the Trident binary, dlv and busybox is appended to it, and the
+// result is pushed. Apart from the binary, the debug image is the installed image. For ImageDlv, dlv and busybox
+// alone are appended.
+// The base image is given by opts.BaseImage. It returns the reference of the pushed image pinned by digest.
+func Layer(opts Options) (string, error) {
+	if opts.Arch == "" {
+		opts.Arch = DefaultArch
+	}
+	sourcePath, err := filepath.Abs(opts.SourcePath)
+	if err != nil {
+		return "", err
+	}
+	opts.SourcePath = sourcePath
+	if err = resolveDlvVersion(&opts); err != nil {
+		return "", err
+	}
+
+	var nameOptions []name.Option
+	if opts.Insecure {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	baseReference, err := name.ParseReference(opts.BaseImage, nameOptions...)
+	if err != nil {
+		return "", fmt.Errorf("invalid base image %s: %v", opts.BaseImage, err)
+	}
+	reference, err := name.ParseReference(opts.Reference, nameOptions...)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %v", opts.Reference, err)
+	}
+
+	// The image is rebuilt whenever the installed image changes, so the base is identified by digest.
+	remoteOptions := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	baseDescriptor, err := remote.Head(baseReference, remoteOptions...)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the image %s: %v", opts.BaseImage, err)
+	}
+	hash, err := contentHash(opts, []byte(baseDescriptor.Digest.String()+"\n"+busyboxImage))
+	if err != nil {
+		return "", err
+	}
+	if !opts.NoCache {
+		if cached := cachedImage(hash, opts.Insecure); cached != "" {
+			fmt.Println("Reusing the cached image", cached)
+			return cached, nil
+		}
+	}
+
+	contextDir, err := os.MkdirTemp("", "trident-debug-layer-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create the layer directory: %v", err)
+	}
+	defer os.RemoveAll(contextDir)
+
+	// The installed image already holds everything else, only the debugged binary is replaced, and busybox is
+	// added for trident-debug's own use, as in the Dockerfiles. The dlv image adds dlv and busybox alone.
+	files := []string{dlvName, busyboxPath}
+	history := dlvLayerHistory
+	if binaries, _ := imageContent(opts.Image); len(binaries) > 0 {
+		bin := binaries[0]
+		if err = mainBinary(opts, bin, linkerFlags(opts.SourcePath), contextDir); err != nil {
+			return "", err
+		}
+		files = append(files, bin.name)
+		history = fmt.Sprintf(layerHistory, bin.name)
+	}
+	if err = fetchBusybox(opts.Arch, contextDir, remoteOptions); err != nil {
+		return "", err
+	}
+	if err = dlvCompiler(opts.Arch, opts.DlvVersion, contextDir); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Reading the image %s...\n", opts.BaseImage)
+	base, err := remote.Image(baseReference, append(remoteOptions,
+		remote.WithPlatform(v1.Platform{OS: "linux", Architecture: opts.Arch}))...)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the image %s: %v", opts.BaseImage, err)
+	}
+	config, err := base.ConfigFile()
+	if err != nil {
+		return "", fmt.Errorf("cannot read the configuration of the image %s: %v", opts.BaseImage, err)
+	}
+	if config.Architecture != "" && config.Architecture != opts.Arch {
+		return "", fmt.Errorf("the image %s is built for %s, not %s", opts.BaseImage, config.Architecture,
+			opts.Arch)
+	}
+
+	layerPath := filepath.Join(contextDir, "layer.tar")
+	if err = writeLayer(layerPath, contextDir, files...); err != nil {
+		return "", fmt.Errorf("cannot write the debug layer: %v", err)
+	}
+	layer, err := tarball.LayerFromFile(layerPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the debug layer: %v", err)
+	}
+	image, err := mutate.Append(base, mutate.Addendum{
+		Layer:   layer,
+		History: v1.History{CreatedBy: history},
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot append the debug layer to the image %s: %v", opts.BaseImage, err)
+	}
+
+	fmt.Printf("Pushing the image %s...\n", opts.Reference)
+	if err = remote.Write(reference, image, remoteOptions...); err != nil {
+		return "", fmt.Errorf("cannot push the image %s: %v", opts.Reference, err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+	pushed := Repository(opts.Reference) + "@" + digest.String()
+	cacheImage(hash, pushed)
+	return pushed, nil
+}
+
+// resolveDlvVersion function sets the dlv version of the options to the latest release, unless one is given.
+func resolveDlvVersion(opts *Options) error {
+	if opts.DlvVersion != "" {
+		return nil
+	}
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Version}}", dlvModule+"@latest").Output()
+	if err != nil {
+		return fmt.Errorf("cannot resolve the latest version of dlv: %v", err)
+	}
+	opts.DlvVersion = strings.TrimSpace(string(out))
+	return nil
+}
+
+// compileDlv function builds the version of dlv for linux into the directory. With a GOPATH of its own, go
+// install leaves the cross-compiled binary in the directory instead of the user's GOPATH.
+func compileDlv(arch, version, dir string) error {
+	fmt.Printf("Compiling dlv %s for linux/%s...\n", version, arch)
+	gopath := filepath.Join(dir, "gopath")
+	env := []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=" + arch, "GOPATH=" + gopath, "GOBIN="}
+	// The module cache is kept where it is, so that dlv's dependencies aren't downloaded again.
+	if modCache, err := goEnv("GOMODCACHE"); err == nil && modCache != "" {
+		env = append(env, "GOMODCACHE="+modCache)
+	}
+	if err := run(dir, env, "go", "install", dlvPackage+"@"+version); err != nil {
+		return fmt.Errorf("cannot compile dlv: %v", err)
+	}
+
+	for _, binary := range []string{
+		filepath.Join(gopath, "bin", dlvName),
+		filepath.Join(gopath, "bin", "linux_"+arch, dlvName),
+	} {
+		if _, err := os.Stat(binary); err == nil {
+			return os.Rename(binary, filepath.Join(dir, dlvName))
+		}
+	}
+	return fmt.Errorf("cannot find the compiled dlv in %s", gopath)
+}
+
+// fetchBusybox function extracts busybox for linux of the architecture from its image into the directory, at
+// busyboxPath.
+func fetchBusybox(arch, dir string, remoteOptions []remote.Option) error {
+	fmt.Printf("Fetching busybox for linux/%s from %s...\n", arch, busyboxImage)
+	reference, err := name.ParseReference(busyboxImage)
+	if err != nil {
+		return fmt.Errorf("invalid busybox image %s: %v", busyboxImage, err)
+	}
+	image, err := remote.Image(reference, append(remoteOptions,
+		remote.WithPlatform(v1.Platform{OS: "linux", Architecture: arch}))...)
+	if err != nil {
+		return fmt.Errorf("cannot read the image %s: %v", busyboxImage, err)
+	}
+
+	content := mutate.Extract(image)
+	defer content.Close()
+	reader := tar.NewReader(content)
+	// The applets are hard links to busybox, which may itself be stored as a link to the first of them.
+	regularFiles := make(map[string][]byte)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read the image %s: %v", busyboxImage, err)
+		}
+		entry := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if !strings.HasPrefix(entry, "bin/") {
+				continue
+			}
+			if regularFiles[entry], err = io.ReadAll(reader); err != nil {
+				return fmt.Errorf("cannot read the image %s: %v", busyboxImage, err)
+			}
+		case tar.TypeLink:
+			if entry == busyboxPath {
+				regularFiles[entry] = regularFiles[path.Clean(strings.TrimPrefix(header.Linkname, "/"))]
+			}
+		}
+	}
+
+	busybox := regularFiles[busyboxPath]
+	if len(busybox) == 0 {
+		return fmt.Errorf("cannot find /%s in the image %s", busyboxPath, busyboxImage)
+	}
+	busyboxFile := filepath.Join(dir, filepath.FromSlash(busyboxPath))
+	if err = os.MkdirAll(filepath.Dir(busyboxFile), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(busyboxFile, busybox, 0755)
+}
+
+// goEnv function returns the value of the go environment variable.
+func goEnv(variable string) (string, error) {
+	out, err := exec.Command("go", "env", variable).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// writeLayer function writes a layer tarball holding the files of the directory at the root of the image.
+func writeLayer(path, dir string, files ...string) error {
+	layerFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer layerFile.Close()
+
+	writer := tar.NewWriter(layerFile)
+	for _, file := range files {
+		if err = addExecutable(writer, filepath.Join(dir, file), file); err != nil {
+			return err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return layerFile.Close()
+}
+
+// addExecutable function adds the file to the tarball as an executable with the given name.
+func addExecutable(writer *tar.Writer, path, fileName string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fileName,
+		Mode:     0755,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
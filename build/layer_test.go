@@ -0,0 +1,226 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// TestLayer assembles a debug image against an in-memory registry standing in for the one of the cluster, and
+// checks the appended layer.
+func TestLayer(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	base, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: "linux", Architecture: runtime.GOARCH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		layer, err := random.Layer(512, types.OCIUncompressedLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base, err = mutate.AppendLayers(base, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseImage := host + "/netapp/trident:24.06.0"
+	pushImage(t, baseImage, base)
+
+	// busybox:musl stores busybox as a hard link to the first applet.
+	busybox := imageWithFiles(t, []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/[", Mode: 0755, Size: int64(len("busybox"))},
+		{Typeflag: tar.TypeLink, Name: "bin/busybox", Linkname: "bin/["},
+	}, "busybox")
+	defer setBusyboxImage(host + "/library/busybox:musl")()
+	pushImage(t, busyboxImage, busybox)
+
+	defer setDlvCompiler(func(arch, version, dir string) error {
+		return os.WriteFile(filepath.Join(dir, dlvName), []byte("dlv"), 0755)
+	})()
+
+	binary := buildBinary(t)
+	pushed, err := Layer(Options{
+		SourcePath: t.TempDir(),
+		Image:      ImageTrident,
+		Arch:       runtime.GOARCH,
+		Reference:  host + "/me/trident-debug:test",
+		BaseImage:  baseImage,
+		Binary:     binary,
+		DlvVersion: "v1.0.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pushed, host+"/me/trident-debug@sha256:") {
+		t.Fatalf("the pushed image %s isn't pinned by digest", pushed)
+	}
+
+	reference, err := name.ParseReference(pushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := remote.Image(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 3 {
+		t.Fatalf("the image has %d layers, want the 2 of the base and the debug layer", len(layers))
+	}
+
+	files := layerFiles(t, layers[2])
+	if !bytes.Equal(files["bin/busybox"], []byte("busybox")) {
+		t.Errorf("the debug layer holds bin/busybox %q, want the one of the busybox image", files["bin/busybox"])
+	}
+	if string(files[dlvName]) != "dlv" {
+		t.Errorf("the debug layer holds dlv %q, want the compiled one", files[dlvName])
+	}
+	if len(files["trident_orchestrator"]) == 0 {
+		t.Error("the debug layer has no trident_orchestrator")
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history := config.History[len(config.History)-1].CreatedBy; !strings.HasPrefix(history, "trident-debug:") {
+		t.Errorf("the debug layer is recorded as %q", history)
+	}
+}
+
+// buildBinary function compiles a minimal program for linux of the current architecture, with the debug
+// information ValidateBinary requires, and returns its path.
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/debugged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "debugged")
+	command := exec.Command("go", "build", "-o", binary, ".")
+	command.Dir = dir
+	command.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH="+runtime.GOARCH, "GOFLAGS=")
+	if out, err := command.CombinedOutput(); err != nil {
+		t.Fatalf("cannot compile the binary: %v\n%s", err, out)
+	}
+	return binary
+}
+
+// setBusyboxImage function points busyboxImage at the image, and returns the function restoring it.
+func setBusyboxImage(image string) func() {
+	previous := busyboxImage
+	busyboxImage = image
+	return func() { busyboxImage = previous }
+}
+
+// setDlvCompiler function replaces dlvCompiler, and returns the function restoring it.
+func setDlvCompiler(compiler func(arch, version, dir string) error) func() {
+	previous := dlvCompiler
+	dlvCompiler = compiler
+	return func() { dlvCompiler = previous }
+}
+
+// pushImage function pushes the image to the reference.
+func pushImage(t *testing.T, image string, content v1.Image) {
+	t.Helper()
+	reference, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(reference, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// imageWithFiles function returns a linux image of the current architecture with a single layer of the entries,
+// the regular files all holding the content.
+func imageWithFiles(t *testing.T, headers []*tar.Header, content string) v1.Image {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, header := range headers {
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := writer.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buffer.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The configuration holds the layer digests too, so it is set before the layer is appended.
+	image, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: "linux", Architecture: runtime.GOARCH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err = mutate.AppendLayers(image, layer); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// layerFiles function returns the content of the regular files of the layer, by name.
+func layerFiles(t *testing.T, layer v1.Layer) map[string][]byte {
+	t.Helper()
+	content, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	files := make(map[string][]byte)
+	reader := tar.NewReader(content)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[header.Name], err = io.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
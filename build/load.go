@@ -0,0 +1,71 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// LoadKind loads the debug image into the nodes of a kind cluster.
+	LoadKind = "kind"
+	// LoadMinikube loads the debug image into a minikube cluster.
+	LoadMinikube = "minikube"
+	// LoadK3d loads the debug image into the nodes of a k3d cluster.
+	LoadK3d = "k3d"
+
+	// LocalRegistry is the registry prefix of debug images loaded into a local cluster. It is never pulled from.
+	LocalRegistry = "trident-debug.local"
+
+	defaultKindCluster     = "kind"
+	defaultMinikubeProfile = "minikube"
+	defaultK3dCluster      = "k3s-default"
+)
+
+// DetectLocalCluster function returns the local cluster tool and the cluster name the kubeconfig context was
+// created by, going by the context names kind, minikube and k3d give. The tool is empty for other clusters.
+func DetectLocalCluster(context string) (tool, cluster string) {
+	switch {
+	case strings.HasPrefix(context, "kind-"):
+		return LoadKind, strings.TrimPrefix(context, "kind-")
+	case strings.HasPrefix(context, "k3d-"):
+		return LoadK3d, strings.TrimPrefix(context, "k3d-")
+	case context == defaultMinikubeProfile:
+		return LoadMinikube, context
+	default:
+		return "", ""
+	}
+}
+
+// DefaultCluster function returns the name the tool gives to its cluster when none is chosen.
+func DefaultCluster(tool string) string {
+	switch tool {
+	case LoadKind:
+		return defaultKindCluster
+	case LoadMinikube:
+		return defaultMinikubeProfile
+	case LoadK3d:
+		return defaultK3dCluster
+	default:
+		return ""
+	}
+}
+
+// LoadImage function side-loads the image from the local docker daemon into the nodes of the cluster.
+func LoadImage(tool, cluster, reference string) error {
+	fmt.Printf("Loading the image %s into the %s cluster %s...\n", reference, tool, cluster)
+	var err error
+	switch tool {
+	case LoadKind:
+		err = run("", nil, "kind", "load", "docker-image", reference, "--name", cluster)
+	case LoadMinikube:
+		err = run("", nil, "minikube", "image", "load", reference, "--profile", cluster)
+	case LoadK3d:
+		err = run("", nil, "k3d", "image", "import", reference, "--cluster", cluster)
+	default:
+		return fmt.Errorf("unknown local cluster type %s", tool)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot load the image %s into the %s cluster %s: %v", reference, tool, cluster, err)
+	}
+	return nil
+}
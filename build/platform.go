@@ -0,0 +1,95 @@
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// VerifyImageArch function refuses an image that can't run on linux nodes of the architecture. Images in a
+// registry are checked through their manifest, or the manifests of their index, and local images, which are loaded
+// into the cluster from the docker daemon, through the daemon.
+func VerifyImageArch(reference, arch string, local, insecure bool) error {
+	archs, err := imageArchs(reference, local, insecure)
+	if err != nil {
+		return fmt.Errorf("cannot find the platform of the image %s: %v", reference, err)
+	}
+	if len(archs) == 0 {
+		return fmt.Errorf("the image %s isn't built for linux", reference)
+	}
+	for _, imageArch := range archs {
+		if imageArch == arch {
+			return nil
+		}
+	}
+	return fmt.Errorf("the image %s is built for linux/%s, the nodes are linux/%s", reference,
+		strings.Join(archs, ", linux/"), arch)
+}
+
+// imageArchs function returns the linux architectures the image is available for.
+func imageArchs(reference string, local, insecure bool) ([]string, error) {
+	if local {
+		out, err := exec.Command(dockerCLI, "image", "inspect", "--format", "{{.Os}}/{{.Architecture}}",
+			reference).Output()
+		if err != nil {
+			return nil, err
+		}
+		return linuxArchs(strings.Fields(string(out))), nil
+	}
+
+	var nameOptions []name.Option
+	if insecure {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	ref, err := name.ParseReference(reference, nameOptions...)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+
+	if descriptor.MediaType.IsIndex() {
+		index, err := descriptor.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		var platforms []string
+		for _, image := range manifest.Manifests {
+			if image.Platform != nil {
+				platforms = append(platforms, image.Platform.OS+"/"+image.Platform.Architecture)
+			}
+		}
+		return linuxArchs(platforms), nil
+	}
+
+	image, err := descriptor.Image()
+	if err != nil {
+		return nil, err
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return linuxArchs([]string{config.OS + "/" + config.Architecture}), nil
+}
+
+// linuxArchs function returns the architectures of the linux platforms, given as os/arch.
+func linuxArchs(platforms []string) []string {
+	var archs []string
+	for _, platform := range platforms {
+		if arch, found := strings.CutPrefix(platform, "linux/"); found {
+			archs = append(archs, arch)
+		}
+	}
+	return archs
+}
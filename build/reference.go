@@ -0,0 +1,102 @@
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// NetAppRegistry is the registry the artifactory namespace and folder options refer to.
+	NetAppRegistry = "docker.repo.eng.netapp.com"
+
+	tridentDebugImageName  = "trident-debug"
+	operatorDebugImageName = "trident-operator-debug"
+	dlvImageName           = "trident-debug-dlv"
+
+	gitHashTagLength = 12
+)
+
+// ImageName function returns the repository name of the debug image of the kind.
+func ImageName(image string) string {
+	switch image {
+	case ImageOperator:
+		return operatorDebugImageName
+	case ImageDlv:
+		return dlvImageName
+	default:
+		return tridentDebugImageName
+	}
+}
+
+// Reference function returns the reference the debug image is built and pushed as. The registry is either a
+// full image reference with a tag, used as is, or a registry and repository prefix the
+// image name and a tag unique to the Trident source tree are appended to,
+// e.g. `ghcr.io/me/trident-debug:0123456789ab-dirty-20240101-120000`.
+func Reference(registry, image, sourcePath string) (string, error) {
+	registry = strings.TrimSuffix(strings.TrimSpace(registry), "/")
+	if registry == "" {
+		return "", fmt.Errorf("no registry given")
+	}
+	if strings.ContainsAny(registry, " \t") {
+		return "", fmt.Errorf("invalid registry %q", registry)
+	}
+	if isFullReference(registry) {
+		if strings.Contains(registry, "@") {
+			return "", fmt.Errorf("the image %s is given by digest, please give a tag to push the debug image to",
+				registry)
+		}
+		return registry, nil
+	}
+	return registry + "/" + ImageName(image) + ":" + DefaultTag(sourcePath), nil
+}
+
+// isFullReference function tells whether the reference names an image with a tag or a digest, rather than a
+// registry and repository prefix. A bare registry host, possibly with a port, is a prefix.
+func isFullReference(reference string) bool {
+	slash := strings.LastIndex(reference, "/")
+	if slash < 0 {
+		return false
+	}
+	return strings.ContainsAny(reference[slash+1:], ":@")
+}
+
+// Repository function returns the reference without its tag or digest.
+func Repository(reference string) string {
+	if at := strings.Index(reference, "@"); at >= 0 {
+		reference = reference[:at]
+	}
+	if colon := strings.LastIndex(reference, ":"); colon > strings.LastIndex(reference, "/") {
+		reference = reference[:colon]
+	}
+	return reference
+}
+
+// DefaultTag function returns an image tag which is never reused for different sources: the git hash of the
+// Trident source tree, with a timestamp when the tree has uncommitted changes.
+func DefaultTag(sourcePath string) string {
+	hash, dirty := gitHash(sourcePath)
+	if hash == "" {
+		return "unknown-" + time.Now().Format("20060102-150405")
+	}
+	if len(hash) > gitHashTagLength {
+		hash = hash[:gitHashTagLength]
+	}
+	if dirty {
+		return hash + "-dirty-" + time.Now().Format("20060102-150405")
+	}
+	return hash
+}
+
+// gitHash function returns the commit hash of the Trident source tree, and whether the tree has uncommitted
+// changes. The hash is empty when it can't be found out.
+func gitHash(sourcePath string) (string, bool) {
+	out, err := exec.Command("git", "-C", sourcePath, "describe", "--match=NeVeRmAtCh", "--always", "--abbrev=40",
+		"--dirty").Output()
+	if err != nil {
+		return "", false
+	}
+	hash := strings.TrimSpace(string(out))
+	return strings.TrimSuffix(hash, "-dirty"), strings.HasSuffix(hash, "-dirty")
+}
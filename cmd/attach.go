@@ -0,0 +1,398 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/debug"
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	defaultStackDepth = 20
+	goroutinesPerPage = 100
+)
+
+var dlvAddress string
+
+func init() {
+	attachCmd.Flags().StringVar(&dlvAddress, "address", "",
+		"Address of a forwarded dlv server, for example localhost:40000. By default a port-forward to the debug pod "+
+			"of the target is opened")
+	RootCmd.AddCommand(attachCmd)
+}
+
+// attachCmd connects to the dlv server of a debug session and offers a small debugger REPL.
+var attachCmd = &cobra.Command{
+	Use:          "attach",
+	Short:        "Attaches a terminal debugger to the dlv server of a debug session",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dlvClient, closeClient, err := connectDlv(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeClient()
+
+		repl := &debugREPL{client: dlvClient}
+		return repl.run()
+	},
+}
+
+// connectDlv connects to the dlv server of the debug session selected by the persistent flags.
+func connectDlv(cmd *cobra.Command) (*dlv.Client, func(), error) {
+	return debug.ConnectDlv(sessionOptions(cmd), dlvAddress)
+}
+
+// sessionOptions returns the options selecting the running debug session the command works on.
+// Unless the local port is chosen explicitly, a free one is used, as the session forwards the default port.
+func sessionOptions(cmd *cobra.Command) debug.Options {
+	opts := debug.Options{
+		KubeConfigPath: kubeConfigPath,
+		Target:         target,
+		NodeName:       nodeName,
+		RemotePort:     remotePort,
+	}
+	if cmd.Flags().Changed("local-port") {
+		opts.LocalPort = localPort
+	}
+	return opts
+}
+
+// debugREPL is a minimal line based debugger working through the dlv JSON-RPC API.
+type debugREPL struct {
+	client *dlv.Client
+	// goroutineID is the goroutine stack and print apply to, 0 meaning the current one.
+	goroutineID int64
+}
+
+type replCommand struct {
+	aliases []string
+	usage   string
+	run     func(r *debugREPL, args []string) error
+}
+
+var replCommands = []replCommand{
+	{[]string{"break", "b"}, "break <location> [if <condition>]  set a breakpoint, e.g. break csi.(*Plugin).CreateVolume",
+		(*debugREPL).breakpoint},
+	{[]string{"breakpoints", "bp"}, "breakpoints  list the breakpoints", (*debugREPL).breakpoints},
+	{[]string{"clear"}, "clear <id>  remove a breakpoint", (*debugREPL).clear},
+	{[]string{"continue", "c"}, "continue  run until the next breakpoint, Ctrl-C halts", (*debugREPL).continueRun},
+	{[]string{"next", "n"}, "next  step over to the next source line", (*debugREPL).next},
+	{[]string{"step", "s"}, "step  step into the next source line", (*debugREPL).step},
+	{[]string{"stepout", "so"}, "stepout  step out of the current function", (*debugREPL).stepOut},
+	{[]string{"halt"}, "halt  suspend the process", (*debugREPL).halt},
+	{[]string{"goroutines", "grs"}, "goroutines  list the goroutines", (*debugREPL).goroutines},
+	{[]string{"goroutine", "gr"}, "goroutine <id>  select the goroutine stack and print apply to",
+		(*debugREPL).goroutine},
+	{[]string{"stack", "bt"}, "stack [depth]  print the stack of the selected goroutine", (*debugREPL).stack},
+	{[]string{"print", "p"}, "print <expression>  evaluate an expression in the selected goroutine",
+		(*debugREPL).print},
+}
+
+func (r *debugREPL) run() error {
+	fmt.Println("Type 'help' for the list of commands, 'exit' to detach.")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("(trident-debug) ")
+		if !scanner.Scan() {
+			break
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		name, args := fields[0], fields[1:]
+		switch name {
+		case "exit", "quit", "q":
+			return r.detach()
+		case "help", "h":
+			for _, command := range replCommands {
+				fmt.Println("  " + command.usage)
+			}
+			fmt.Println("  exit  detach, resuming the process if it is halted")
+			continue
+		}
+
+		command := findREPLCommand(name)
+		if command == nil {
+			fmt.Printf("Unknown command %s, type 'help' for the list of commands.\n", name)
+			continue
+		}
+		if err := command.run(r, args); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+
+	return r.detach()
+}
+
+func findREPLCommand(name string) *replCommand {
+	for i := range replCommands {
+		for _, alias := range replCommands[i].aliases {
+			if alias == name {
+				return &replCommands[i]
+			}
+		}
+	}
+	return nil
+}
+
+// detach leaves the process running, so that trident isn't stuck once the REPL is gone.
+func (r *debugREPL) detach() error {
+	state, err := r.client.State()
+	if err != nil {
+		return err
+	}
+	if !state.Running && !state.Exited {
+		fmt.Println("Resuming the process before detaching...")
+		r.client.ContinueAsync()
+	}
+	return nil
+}
+
+func (r *debugREPL) breakpoint(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("a location is required")
+	}
+	bp := &dlv.Breakpoint{}
+	location := args[0]
+	if len(args) > 2 && args[1] == "if" {
+		bp.Cond = strings.Join(args[2:], " ")
+	}
+
+	return r.client.WithHalted(func() error {
+		created, err := r.client.CreateBreakpoint(bp, location)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Breakpoint %d set at %s\n", created.ID, formatBreakpointLocation(created))
+		return nil
+	})
+}
+
+func (r *debugREPL) breakpoints(_ []string) error {
+	var breakpoints []*dlv.Breakpoint
+	err := r.client.WithHalted(func() (err error) {
+		breakpoints, err = r.client.ListBreakpoints()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, bp := range breakpoints {
+		if bp.ID < 0 {
+			// Negative IDs are delve's internal breakpoints, e.g. the one for unrecovered panics.
+			continue
+		}
+		line := fmt.Sprintf("Breakpoint %d at %s (%d hits)", bp.ID, formatBreakpointLocation(bp), bp.TotalHitCount)
+		if bp.Cond != "" {
+			line += " if " + bp.Cond
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func (r *debugREPL) clear(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("a breakpoint id is required")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid breakpoint id %s", args[0])
+	}
+
+	return r.client.WithHalted(func() error {
+		bp, err := r.client.ClearBreakpoint(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Breakpoint %d cleared at %s\n", bp.ID, formatBreakpointLocation(bp))
+		return nil
+	})
+}
+
+// continueRun resumes the process until it stops again, Ctrl-C halts it meanwhile.
+func (r *debugREPL) continueRun(_ []string) error {
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigint)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-sigint:
+			fmt.Println("Halting...")
+			_, _ = r.client.Halt()
+		case <-done:
+		}
+	}()
+
+	return r.stepCommand(r.client.Continue)
+}
+
+func (r *debugREPL) next(_ []string) error {
+	return r.stepCommand(r.client.Next)
+}
+
+func (r *debugREPL) step(_ []string) error {
+	return r.stepCommand(r.client.Step)
+}
+
+func (r *debugREPL) stepOut(_ []string) error {
+	return r.stepCommand(r.client.StepOut)
+}
+
+func (r *debugREPL) halt(_ []string) error {
+	return r.stepCommand(r.client.Halt)
+}
+
+// stepCommand runs a command changing the execution state and prints where the process stopped.
+func (r *debugREPL) stepCommand(command func() (*dlv.DebuggerState, error)) error {
+	state, err := command()
+	if err != nil {
+		return err
+	}
+	r.goroutineID = 0
+	printState(state)
+	return nil
+}
+
+func (r *debugREPL) goroutines(_ []string) error {
+	return r.client.WithHalted(func() error {
+		for start := 0; ; {
+			goroutines, next, err := r.client.ListGoroutines(start, goroutinesPerPage)
+			if err != nil {
+				return err
+			}
+			for _, g := range goroutines {
+				fmt.Printf("  Goroutine %d - %s\n", g.ID, formatLocation(&g.UserCurrentLoc))
+			}
+			if next <= 0 {
+				return nil
+			}
+			start = next
+		}
+	})
+}
+
+func (r *debugREPL) goroutine(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("a goroutine id is required")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid goroutine id %s", args[0])
+	}
+	if _, err = r.client.SwitchGoroutine(id); err != nil {
+		return err
+	}
+	r.goroutineID = id
+	fmt.Printf("Switched to goroutine %d\n", id)
+	return nil
+}
+
+func (r *debugREPL) stack(args []string) error {
+	depth := defaultStackDepth
+	if len(args) > 0 {
+		var err error
+		if depth, err = strconv.Atoi(args[0]); err != nil {
+			return fmt.Errorf("invalid depth %s", args[0])
+		}
+	}
+
+	goroutineID, err := r.selectedGoroutine()
+	if err != nil {
+		return err
+	}
+	frames, err := r.client.Stacktrace(goroutineID, depth, nil)
+	if err != nil {
+		return err
+	}
+	for i := range frames {
+		fmt.Printf("%2d  %s\n", i, formatLocation(&frames[i].Location))
+	}
+	return nil
+}
+
+func (r *debugREPL) print(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("an expression is required")
+	}
+	goroutineID, err := r.selectedGoroutine()
+	if err != nil {
+		return err
+	}
+	variable, err := r.client.Eval(goroutineID, 0, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Println(dlv.FormatVariable(variable))
+	return nil
+}
+
+// selectedGoroutine returns the goroutine chosen with the goroutine command, or else the current one.
+// The process has to be halted, as dlv only reads stacks and variables of a stopped process.
+func (r *debugREPL) selectedGoroutine() (int64, error) {
+	state, err := r.client.State()
+	if err != nil {
+		return 0, err
+	}
+	if state.Running {
+		return 0, fmt.Errorf("the process is running, halt it first")
+	}
+	if r.goroutineID != 0 {
+		return r.goroutineID, nil
+	}
+	if state.SelectedGoroutine == nil {
+		return 0, fmt.Errorf("no goroutine is selected")
+	}
+	return state.SelectedGoroutine.ID, nil
+}
+
+func printState(state *dlv.DebuggerState) {
+	if state.Exited {
+		fmt.Printf("Process %d has exited with status %d\n", state.Pid, state.ExitStatus)
+		return
+	}
+	thread := state.CurrentThread
+	if thread == nil {
+		fmt.Println("The process is stopped")
+		return
+	}
+
+	location := formatLocation(&dlv.Location{File: thread.File, Line: thread.Line, Function: thread.Function})
+	if thread.Breakpoint != nil && thread.Breakpoint.ID > 0 {
+		fmt.Printf("> [Breakpoint %d] goroutine %d %s\n", thread.Breakpoint.ID, thread.GoroutineID, location)
+	} else {
+		fmt.Printf("> goroutine %d %s\n", thread.GoroutineID, location)
+	}
+	for i := range thread.ReturnValues {
+		fmt.Printf("  %s = %s\n", thread.ReturnValues[i].Name, dlv.FormatVariable(&thread.ReturnValues[i]))
+	}
+}
+
+func formatLocation(location *dlv.Location) string {
+	function := "?"
+	if location.Function != nil {
+		function = location.Function.Name
+	}
+	return fmt.Sprintf("%s() %s:%d", function, location.File, location.Line)
+}
+
+func formatBreakpointLocation(bp *dlv.Breakpoint) string {
+	if bp.FunctionName != "" {
+		return fmt.Sprintf("%s() %s:%d", bp.FunctionName, bp.File, bp.Line)
+	}
+	return fmt.Sprintf("%s:%d", bp.File, bp.Line)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+var coreOutput string
+
+func init() {
+	coreCmd.Flags().StringVarP(&coreOutput, "output", "o", "",
+		"Directory the core dump and the debug binary are written to, by default core-<target>-<time>")
+	RootCmd.AddCommand(coreCmd)
+}
+
+// coreCmd downloads a core dump of the debugged trident, along with its debug binary, for post-mortem analysis.
+var coreCmd = &cobra.Command{
+	Use:          "core",
+	Short:        "Writes a core dump of the debugged process and downloads it with the debug binary",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		corePath, binaryPath, err := debug.CaptureCore(sessionOptions(cmd), coreOutput)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("The core dump is stored, open it with:")
+		fmt.Printf("  dlv core %s %s\n", binaryPath, corePath)
+		return nil
+	},
+}
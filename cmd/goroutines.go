@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+const (
+	reportFormatText = "text"
+	reportFormatJSON = "json"
+)
+
+var (
+	goroutinesOutput     string
+	goroutinesFormat     string
+	goroutinesStackDepth int
+)
+
+func init() {
+	goroutinesCmd.Flags().StringVar(&dlvAddress, "address", "",
+		"Address of a forwarded dlv server, for example localhost:40000. By default a port-forward to the debug pod "+
+			"of the target is opened")
+	goroutinesCmd.Flags().StringVarP(&goroutinesOutput, "output", "o", "",
+		"File the report is written to, by default goroutines-<time>.txt or .json in the current directory")
+	goroutinesCmd.Flags().StringVar(&goroutinesFormat, "format", reportFormatText,
+		"Format of the report, either text or json")
+	goroutinesCmd.Flags().IntVar(&goroutinesStackDepth, "depth", 0,
+		"Maximum number of frames read per goroutine, 0 reads whole stacks. Stacks cut at the depth are only grouped "+
+			"with stacks cut at the same frames")
+	RootCmd.AddCommand(goroutinesCmd)
+}
+
+// goroutinesCmd writes a snapshot of the goroutines of the debugged trident, grouped by identical stacks.
+var goroutinesCmd = &cobra.Command{
+	Use:          "goroutines",
+	Short:        "Writes a report of every goroutine of the debugged process, grouped by identical stacks",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if goroutinesFormat != reportFormatText && goroutinesFormat != reportFormatJSON {
+			return fmt.Errorf("unknown format %s. Please use either %s or %s", goroutinesFormat, reportFormatText,
+				reportFormatJSON)
+		}
+		if goroutinesStackDepth < 0 {
+			return fmt.Errorf("invalid stack depth %d", goroutinesStackDepth)
+		}
+
+		dlvClient, closeClient, err := connectDlv(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeClient()
+
+		fmt.Println("Collecting the goroutines, the process is halted meanwhile...")
+		report, err := debug.CollectGoroutineReport(dlvClient, goroutinesStackDepth)
+		if err != nil {
+			return err
+		}
+
+		output := goroutinesOutput
+		if output == "" {
+			extension := ".txt"
+			if goroutinesFormat == reportFormatJSON {
+				extension = ".json"
+			}
+			output = "goroutines-" + report.Time.Format("20060102-150405") + extension
+		}
+
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if goroutinesFormat == reportFormatJSON {
+			err = report.WriteJSON(file)
+		} else {
+			err = report.WriteText(file)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d goroutines in %d groups written to %s\n", report.Total, len(report.Groups), output)
+		return nil
+	},
+}
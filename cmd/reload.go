@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/build"
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+var reloadBinary string
+
+func init() {
+	reloadCmd.Flags().StringVar(&reloadBinary, "binary", "",
+		"Reload this prebuilt binary instead of compiling one from the Trident source tree. It must be built for "+
+			"linux without -ldflags \"-s -w\"")
+	RootCmd.AddCommand(reloadCmd)
+}
+
+// reloadCmd swaps a fresh debug build of the debugged binary into the running debug pod, without a new image.
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Rebuilds the debugged binary and restarts it in the running debug pod, keeping the breakpoints",
+	Long: "Rebuilds the debugged binary from the Trident source tree, copies it into the running debug pod and " +
+		"restarts it under dlv in place. The pod, the port-forward of the session and the breakpoints are kept. " +
+		"The pod must run a debug image, which ships busybox.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := sessionOptions(cmd)
+
+		arch, err := debug.NodeArch(kubeConfigPath, target, nodeName)
+		if err != nil {
+			return fmt.Errorf("cannot find the architecture of the nodes: %v", err)
+		}
+
+		image := build.ImageTrident
+		if target == debug.TargetOperator {
+			image = build.ImageOperator
+		}
+
+		outputDir, err := os.MkdirTemp("", "trident-debug-reload-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(outputDir)
+
+		binaryPath, err := build.CompileBinary(build.Options{
+			SourcePath: tridentSourcePath,
+			Image:      image,
+			Arch:       arch,
+			Binary:     reloadBinary,
+		}, outputDir)
+		if err != nil {
+			return err
+		}
+
+		return debug.ReloadBinary(opts, binaryPath)
+	},
+}
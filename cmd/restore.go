@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+var restoreSessionID string
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreSessionID, "session", "",
+		"Restore this session, even if its process is still running. By default the sessions of the current context, "+
+			"or of --target, whose process is gone are restored")
+	RootCmd.AddCommand(restoreCmd)
+}
+
+// restoreCmd reverts the workloads a debug session left modified, from the session records.
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Reverts the workloads left modified by a debug session that couldn't revert them",
+	Long: "Every debug session records the original workload before modifying it, and deletes the record once " +
+		"the workload is reverted. A record left behind means the session was killed or couldn't revert the " +
+		"workload. restore reverts the workloads of these records, from any process. Unless --session is given, the " +
+		"sessions whose process still runs are left alone, and the records whose workload no longer carries the " +
+		"session annotations, reverted or taken over by another session, are deleted as stale.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		states, err := debug.ListSessionStates()
+		if err != nil {
+			return err
+		}
+
+		var selected []*debug.SessionState
+		if restoreSessionID != "" {
+			for _, state := range states {
+				if state.ID == restoreSessionID {
+					selected = append(selected, state)
+				}
+			}
+			if len(selected) == 0 {
+				return fmt.Errorf("no record of the session %s", restoreSessionID)
+			}
+		} else {
+			kubeContext, err := debug.CurrentContext(kubeConfigPath)
+			if err != nil {
+				return err
+			}
+			for _, state := range states {
+				if state.Context != kubeContext {
+					continue
+				}
+				if cmd.Flags().Changed("target") && (state.Target != target || state.NodeName != nodeName) {
+					continue
+				}
+				status, err := debug.SessionStatus(state, kubeConfigPath)
+				if err != nil {
+					fmt.Printf("Cannot check the session %s, skipping it: %v\n", state.ID, err)
+					continue
+				}
+				switch status {
+				case debug.SessionLive:
+					fmt.Printf("The session %s is still running in the process %d on %s, skipping it; restore it "+
+						"anyway with: trident-debug restore --session %s\n", state.ID, state.PID, state.Host, state.ID)
+				case debug.SessionStale:
+					fmt.Printf("The %s %s is no longer debugged by the session %s, deleting its stale record\n",
+						strings.ToLower(state.Kind), state.Name, state.ID)
+					debug.DiscardSession(state)
+				default:
+					selected = append(selected, state)
+				}
+			}
+			if len(selected) == 0 {
+				fmt.Printf("No debug session of the context %s to restore\n", kubeContext)
+				return nil
+			}
+		}
+
+		failed := 0
+		for _, state := range selected {
+			fmt.Printf("Restoring the session %s, started %s in %s/%s with the image %s:\n", state.ID,
+				state.Started.Format("2006-01-02 15:04:05"), state.Context, state.Namespace, state.Image)
+			for _, mutation := range state.Mutations {
+				fmt.Println("  -", mutation)
+			}
+			if err = debug.RestoreSession(state, kubeConfigPath); err != nil {
+				fmt.Printf("Cannot restore the session %s: %v\n", state.ID, err)
+				failed++
+				continue
+			}
+			fmt.Printf("The session %s is restored\n", state.ID)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d sessions couldn't be restored", failed, len(selected))
+		}
+		return nil
+	},
+}
@@ -8,7 +8,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"sync"
@@ -16,17 +15,33 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/theshashankpal/trident_debug/build"
 	"github.com/theshashankpal/trident_debug/debug"
 )
 
-const (
-	copyDirectory = "copy_directory"
-)
-
 var (
 	artifactoryNamespace string
 	artifactoryFolder    string
+	registry             string
+	loadInto             string
+	fromCluster          bool
+	insecureRegistry     bool
+	existingImage        string
+	binaryPath           string
+	noCache              bool
+	attachRunning        bool
+	watch                bool
+	existingSession      string
 	kubeConfigPath       string
+	target               string
+	nodeName             string
+	remotePort           int
+	localPort            int
+	tridentSourcePath    string
+	writeVSCodeConfig    bool
+	waitForAttach        bool
+	dlvServer            string
+	breakpointsFile      string
 )
 
 func init() {
@@ -35,6 +50,53 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&artifactoryFolder, "folder", "f", "",
 		"folder in which image will be pushed for example: docker.eng.netapp.com./pshashan/trident-debug")
 	RootCmd.PersistentFlags().StringVarP(&kubeConfigPath, "kubeconfig", "k", "", "Kubernetes config path")
+	RootCmd.PersistentFlags().StringVarP(&target, "target", "t", debug.TargetController,
+		"Trident component to debug, one of controller, node or operator")
+	RootCmd.PersistentFlags().StringVarP(&nodeName, "node", "n", "",
+		"Name of the node whose trident node plugin is debugged, required with --target node")
+	RootCmd.PersistentFlags().IntVar(&remotePort, "remote-port", debug.DefaultRemotePort,
+		"Port dlv listens on inside the debug pod")
+	RootCmd.PersistentFlags().IntVar(&localPort, "local-port", debug.DefaultLocalPort,
+		"Local port forwarded to dlv, 0 picks a free port")
+	RootCmd.PersistentFlags().StringVar(&tridentSourcePath, "trident-source", debug.DefaultTridentSourcePath,
+		"Path of the local Trident source tree the debug image is built from, it is never modified")
+	RootCmd.Flags().StringVar(&registry, "registry", "",
+		"Registry and repository the debug image is pushed to, for example ghcr.io/me, tagged after the Trident "+
+			"git hash, or a full image reference with a tag. Defaults to the artifactory namespace and folder")
+	RootCmd.Flags().StringVar(&loadInto, "load-into", "",
+		"Load the debug image into the nodes of a local cluster instead of pushing it, one of kind, minikube or "+
+			"k3d. Detected from the kubeconfig context when neither a registry nor an artifactory is given")
+	RootCmd.Flags().BoolVar(&fromCluster, "from-cluster", false,
+		"Assemble the debug image without docker, by appending the debug binary and dlv to the image the target "+
+			"runs in the cluster, and push it to the registry")
+	RootCmd.Flags().BoolVar(&insecureRegistry, "insecure-registry", false,
+		"Allow plain HTTP and unverified certificates for the registries of --from-cluster")
+	RootCmd.Flags().StringVar(&existingImage, "image", "",
+		"Debug with this existing debug image instead of building one, it must hold dlv and the debug build of the "+
+			"target binary")
+	RootCmd.Flags().StringVar(&binaryPath, "binary", "",
+		"Package this prebuilt trident_orchestrator, or trident-operator with --target operator, instead of "+
+			"compiling one. It must be built for linux without -ldflags \"-s -w\"")
+	RootCmd.Flags().BoolVar(&noCache, "no-cache", false,
+		"Build and push the debug image even if an image of the same sources, flags and Dockerfile was pushed before")
+	RootCmd.Flags().BoolVar(&attachRunning, "attach-running", false,
+		"Attach dlv to the running trident from an ephemeral container of its pod, without restarting it or "+
+			"modifying its workload. The running binary must have its debug information")
+	RootCmd.Flags().BoolVar(&watch, "watch", false,
+		"Rebuild the debugged binary whenever a .go file of the Trident source tree changes, and reload it in the "+
+			"debug pod, keeping the pod, the port-forward and the breakpoints")
+	RootCmd.Flags().StringVar(&existingSession, "existing-session", debug.ExistingSessionAsk,
+		"What to do when the target is already debugged by another session, one of ask, take-over (restore it "+
+			"and start this session), restore (restore it only) or abort")
+	RootCmd.Flags().BoolVar(&writeVSCodeConfig, "write-vscode", false,
+		"Write the generated launch configuration into the .vscode directory of the Trident source tree")
+	RootCmd.Flags().BoolVar(&waitForAttach, "wait-for-attach", false,
+		"Keep trident halted under dlv until a debugger attaches, its probes are disabled meanwhile")
+	RootCmd.Flags().StringVar(&breakpointsFile, "breakpoints", "",
+		"YAML file of breakpoints and tracepoints set as soon as the session is ready")
+	RootCmd.Flags().StringVar(&dlvServer, "dlv-server", debug.DlvServerRPC,
+		"Protocol of the in-pod debugger, either rpc (JSON-RPC) or dap (Debug Adapter Protocol, trident is "+
+			"launched by the editor)")
 	RootCmd.SetOut(os.Stdout)
 }
 
@@ -45,56 +107,193 @@ var RootCmd = &cobra.Command{
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		if artifactoryNamespace == "" {
-			return fmt.Errorf("artifactory namespace is required. Please provide the namespace using --artifactory or -a flag")
+		switch loadInto {
+		case "", build.LoadKind, build.LoadMinikube, build.LoadK3d:
+		default:
+			return fmt.Errorf("unknown local cluster type %s. Please use one of %s, %s or %s", loadInto,
+				build.LoadKind, build.LoadMinikube, build.LoadK3d)
 		}
 
-		err := os.MkdirAll("./"+copyDirectory, 0755)
-		if err != nil {
-			fmt.Printf("Cannot create copy_directory: %v\n", err)
-			return err
+		switch existingSession {
+		case debug.ExistingSessionAsk, debug.ExistingSessionTakeOver, debug.ExistingSessionRestore,
+			debug.ExistingSessionAbort:
+		default:
+			return fmt.Errorf("unknown --existing-session %s. Please use one of %s, %s, %s or %s", existingSession,
+				debug.ExistingSessionAsk, debug.ExistingSessionTakeOver, debug.ExistingSessionRestore,
+				debug.ExistingSessionAbort)
 		}
 
-		// Copying the Makefile to the copy directory
-		cmdCopy := exec.Command("cp", "./../Makefile", copyDirectory+"/")
-		err = cmdCopy.Run()
-		if err != nil {
-			fmt.Println("Cannot copy makefile to copy_directory: ", err)
-			return err
+		if fromCluster && loadInto != "" {
+			return fmt.Errorf("--from-cluster pushes the image to a registry, it can't be used with --load-into")
+		}
+		if insecureRegistry && !fromCluster {
+			return fmt.Errorf("--insecure-registry is only used with --from-cluster")
+		}
+		if attachRunning && binaryPath != "" {
+			return fmt.Errorf("--attach-running debugs the running binary, it can't be used with --binary")
+		}
+		if attachRunning && dlvServer == debug.DlvServerDAP {
+			return fmt.Errorf("--attach-running only works with the %s dlv server", debug.DlvServerRPC)
+		}
+		if watch && (attachRunning || binaryPath != "" || dlvServer == debug.DlvServerDAP) {
+			return fmt.Errorf("--watch rebuilds the binary from the sources and reloads it through the %s dlv "+
+				"server, it can't be used with --attach-running, --binary or --dlv-server %s", debug.DlvServerRPC,
+				debug.DlvServerDAP)
+		}
+		if existingImage != "" && (binaryPath != "" || fromCluster) {
+			return fmt.Errorf("--image skips the build, it can't be used with --binary or --from-cluster")
 		}
 
-		// Copying the Dockerfile to the copy directory
-		cmdCopy = exec.Command("cp", "./../Dockerfile", copyDirectory+"/")
-		err = cmdCopy.Run()
-		if err != nil {
-			fmt.Println("Cannot copy dockerfile to copy_directory: ", err)
-			return err
+		// Local clusters are recognized by the name of the context their tool created.
+		var loadCluster string
+		if loadInto != "" || (registry == "" && artifactoryNamespace == "" && !fromCluster && existingImage == "") {
+			kubeContext, err := debug.CurrentContext(kubeConfigPath)
+			if err != nil {
+				fmt.Println("Cannot read the current kubeconfig context:", err)
+			}
+			detected, cluster := build.DetectLocalCluster(kubeContext)
+			if loadInto == "" && detected != "" {
+				fmt.Printf("Detected the %s cluster %s, the debug image is loaded into it\n", detected, cluster)
+				loadInto = detected
+			}
+			loadCluster = build.DefaultCluster(loadInto)
+			if detected == loadInto {
+				loadCluster = cluster
+			}
 		}
 
-		// Copying the Makefile to the copy directory
-		cmdCopy = exec.Command("cp", "./Makefile", "./..")
-		err = cmdCopy.Run()
-		if err != nil {
-			fmt.Println("Cannot copy makefile to parent directory: ", err)
-			return err
+		if registry == "" && loadInto != "" {
+			registry = build.LocalRegistry
+		}
+		if registry == "" && existingImage == "" {
+			if artifactoryNamespace == "" {
+				return fmt.Errorf("a registry is required. Please provide it using --registry, the artifactory " +
+					"namespace using --artifactory or -a flag, or load the image into a local cluster using --load-into")
+			}
+			registry = build.NetAppRegistry + "/" + artifactoryNamespace
+			if artifactoryFolder != "" {
+				registry += "/" + artifactoryFolder
+			}
+		}
+
+		switch target {
+		case debug.TargetController, debug.TargetOperator:
+		case debug.TargetNode:
+			if nodeName == "" {
+				return fmt.Errorf("node name is required to debug the node plugin. Please provide it using --node or -n flag")
+			}
+		default:
+			return fmt.Errorf("unknown target %s. Please use one of %s, %s or %s", target, debug.TargetController,
+				debug.TargetNode, debug.TargetOperator)
+		}
+
+		if dlvServer != debug.DlvServerRPC && dlvServer != debug.DlvServerDAP {
+			return fmt.Errorf("unknown dlv server %s. Please use either %s or %s", dlvServer, debug.DlvServerRPC,
+				debug.DlvServerDAP)
+		}
+
+		var breakpoints []debug.BreakpointSpec
+		if breakpointsFile != "" {
+			if dlvServer == debug.DlvServerDAP {
+				return fmt.Errorf("breakpoints can't be set by trident-debug with the dap server, please set them " +
+					"in the editor")
+			}
+			var err error
+			if breakpoints, err = debug.ReadBreakpointFile(breakpointsFile); err != nil {
+				return err
+			}
+		}
+
+		if remotePort <= 0 || remotePort > 65535 {
+			return fmt.Errorf("invalid remote port %d", remotePort)
+		}
+		if localPort < 0 || localPort > 65535 {
+			return fmt.Errorf("invalid local port %d", localPort)
 		}
 
-		// Copying the Dockerfile to the copy directory
-		cmdCopy = exec.Command("cp", "./Dockerfile", "./..")
-		err = cmdCopy.Run()
+		// The image is built for the nodes the target runs on, whatever the architecture of this machine.
+		arch, err := debug.NodeArch(kubeConfigPath, target, nodeName)
 		if err != nil {
-			fmt.Println("Cannot copy dockerfile to parent directory:", err)
-			return err
+			return fmt.Errorf("cannot find the architecture of the nodes: %v", err)
+		}
+		fmt.Printf("The nodes are linux/%s\n", arch)
+		if binaryPath != "" {
+			if err = build.ValidateBinary(binaryPath, arch); err != nil {
+				return err
+			}
+		}
+
+		// The debug image is built from the Trident source tree, which is only read.
+		image := build.ImageTrident
+		if target == debug.TargetOperator {
+			image = build.ImageOperator
+		}
+		if attachRunning {
+			// The running binary is debugged, the image only brings dlv.
+			image = build.ImageDlv
+		}
+		var imageReference string
+		if existingImage == "" {
+			if imageReference, err = build.Reference(registry, image, tridentSourcePath); err != nil {
+				return err
+			}
 		}
 
-		cmdMake := exec.Command("make", "debug", "ARTIFACTORY_NAMESPACE="+artifactoryNamespace, "ARTIFACTORY_FOLDER="+artifactoryFolder, "-C", "./..")
-		cmdMake.Stdout = os.Stdout
-		cmdMake.Stderr = os.Stderr
-		err = cmdMake.Run()
+		opts := debug.Options{
+			KubeConfigPath:    kubeConfigPath,
+			Target:            target,
+			NodeName:          nodeName,
+			RemotePort:        remotePort,
+			RemotePortSet:     cmd.Flags().Changed("remote-port"),
+			LocalPort:         localPort,
+			TridentSourcePath: tridentSourcePath,
+			SourceBuilt:       existingImage == "" && binaryPath == "" && !attachRunning,
+			WriteVSCodeConfig: writeVSCodeConfig,
+			WaitForAttach:     waitForAttach,
+			DlvServer:         dlvServer,
+			Breakpoints:       breakpoints,
+			LocalImage:        loadInto != "",
+			AttachRunning:     attachRunning,
+			Arch:              arch,
+			ExistingSession:   existingSession,
+		}
+
+		// The deployment is pinned to the digest of the pushed image, so that the pod can't run anything else.
+		// An image loaded into a local cluster has no digest in a registry and is referenced by tag.
+		buildOptions := build.Options{
+			SourcePath: tridentSourcePath,
+			Image:      image,
+			Arch:       arch,
+			Reference:  imageReference,
+			DlvPort:    remotePort,
+			LoadInto:   loadInto,
+			Cluster:    loadCluster,
+			Binary:     binaryPath,
+			NoCache:    noCache,
+			Insecure:   insecureRegistry,
+		}
+		if existingImage != "" {
+			opts.Image = existingImage
+			if loadInto != "" {
+				err = build.LoadImage(loadInto, loadCluster, existingImage)
+			}
+		} else if fromCluster {
+			if buildOptions.BaseImage, err = debug.InstalledImage(kubeConfigPath, target); err != nil {
+				fmt.Println("Cannot find the image the target runs: ", err)
+				return err
+			}
+			opts.Image, err = build.Layer(buildOptions)
+		} else {
+			opts.Image, err = build.Build(buildOptions)
+		}
 		if err != nil {
-			fmt.Println("Cannot run make debug: ", err)
+			fmt.Println("Cannot prepare the debug image: ", err)
 			return err
 		}
+		if err = build.VerifyImageArch(opts.Image, arch, loadInto != "", insecureRegistry); err != nil {
+			return err
+		}
+		fmt.Println("Debugging with the image", opts.Image)
 
 		// Creating a context with cancel. This will be used to stop the process
 		ctx, cancel := context.WithCancel(context.Background())
@@ -106,12 +305,20 @@ var RootCmd = &cobra.Command{
 		// Adding the deploymentChan to the context.
 		ctx = context.WithValue(ctx, "deploymentChan", deploymentChan)
 
+		// Interrupting cancels the session, so that the workload is reverted even while it is still rolling out.
+		go func() {
+			sigint := make(chan os.Signal, 1)
+			signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+			<-sigint
+			cancel()
+		}()
+
 		// Wait group to wait for the debug process to complete.
 		var wg sync.WaitGroup
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := debug.InitDebug(ctx, kubeConfigPath, artifactoryNamespace, artifactoryFolder); err != nil {
+			if err := debug.InitDebug(ctx, opts); err != nil {
 				errChan <- err
 			} else {
 				errChan <- nil
@@ -119,7 +326,16 @@ var RootCmd = &cobra.Command{
 		}()
 
 		fmt.Println("Waiting for the deployment to be successful ")
-		<-deploymentChan // Wait for the deployment to be successful
+		select {
+		case <-deploymentChan: // Wait for the deployment to be successful
+		case err = <-errChan:
+			// The debug process ended before the deployment was successful.
+			errChan <- err
+		}
+
+		if watch && err == nil {
+			go watchSources(ctx, build.Options{SourcePath: tridentSourcePath, Image: image, Arch: arch})
+		}
 
 		fmt.Println("Press 'exit' to stop the process...")
 		go func() {
@@ -133,28 +349,9 @@ var RootCmd = &cobra.Command{
 			}
 		}()
 
-		go func() {
-			sigint := make(chan os.Signal, 1)
-			signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
-			<-sigint
-			cancel()
-		}()
-
 		wg.Wait()
 		fmt.Println("Stopping the process...")
 
-		cmdCopy = exec.Command("cp", copyDirectory+"/"+"Makefile", "./..")
-		err = cmdCopy.Run()
-		if err != nil {
-			return err
-		}
-
-		cmdCopy = exec.Command("cp", copyDirectory+"/"+"Dockerfile", "./..")
-		err = cmdCopy.Run()
-		if err != nil {
-			return err
-		}
-
 		select {
 		case err := <-errChan:
 			if err != nil {
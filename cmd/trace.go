@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+const defaultMaxTracedFunctions = 200
+
+var (
+	traceOutput        string
+	maxTracedFunctions int
+)
+
+func init() {
+	traceCmd.Flags().StringVar(&dlvAddress, "address", "",
+		"Address of a forwarded dlv server, for example localhost:40000. By default a port-forward to the debug pod "+
+			"of the target is opened")
+	traceCmd.Flags().StringVarP(&traceOutput, "output", "o", "",
+		"JSONL file the trace is written to, by default trace-<time>.jsonl in the current directory")
+	traceCmd.Flags().IntVar(&maxTracedFunctions, "max-functions", defaultMaxTracedFunctions,
+		"Maximum number of functions traced, as every traced call slows trident down")
+	RootCmd.AddCommand(traceCmd)
+}
+
+// traceCmd streams the calls and returns of trident functions without pausing trident.
+var traceCmd = &cobra.Command{
+	Use:   "trace <pattern>...",
+	Short: "Streams the calls and returns of the functions matching the patterns, without pausing the process",
+	Long: "Streams the calls, with their arguments, and the returns, with their return values, of the functions " +
+		"whose full name matches one of the regular expressions, e.g. 'storage_drivers/ontap.*'. Tracepoints " +
+		"never pause trident for longer than it takes to read the values, so that CSI calls don't time out. " +
+		"The trace is also written as JSON lines to a local file, until 'exit' or Ctrl-C.",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if maxTracedFunctions <= 0 {
+			return fmt.Errorf("invalid maximum number of functions %d", maxTracedFunctions)
+		}
+
+		output := traceOutput
+		if output == "" {
+			output = "trace-" + time.Now().Format("20060102-150405") + ".jsonl"
+		}
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		dlvClient, closeClient, err := connectDlv(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeClient()
+
+		tracer, err := debug.StartTrace(dlvClient, args, maxTracedFunctions, file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("The trace is written to %s. Press 'exit' or Ctrl-C to stop tracing...\n", output)
+		stop := make(chan struct{}, 1)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if strings.ToLower(scanner.Text()) == "exit" {
+					stop <- struct{}{}
+					return
+				}
+			}
+		}()
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigint)
+
+		select {
+		case <-stop:
+		case <-sigint:
+		}
+
+		fmt.Println("Removing the tracepoints...")
+		return tracer.Stop()
+	},
+}
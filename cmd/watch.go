@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theshashankpal/trident_debug/build"
+	"github.com/theshashankpal/trident_debug/debug"
+)
+
+const (
+	// watchInterval is how often the Trident source tree is scanned for changes.
+	watchInterval = time.Second
+	// watchDebounce is how long the sources must stay unchanged before a rebuild, so that a burst of saves
+	// triggers a single one.
+	watchDebounce = 2 * time.Second
+)
+
+// watchSources function rebuilds the debugged binary every time a .go file of the Trident source tree changes,
+// and reloads it in the debug pod of the session, until the context is canceled. Every iteration ends with a
+// status line.
+func watchSources(ctx context.Context, buildOptions build.Options) {
+	snapshot, err := scanSources(buildOptions.SourcePath)
+	if err != nil {
+		fmt.Println("Cannot watch the Trident sources:", err)
+		return
+	}
+	fmt.Printf("Watching the %d .go files of %s for changes...\n", len(snapshot), buildOptions.SourcePath)
+
+	for iteration := 1; ; iteration++ {
+		changed, current, err := waitForChanges(ctx, buildOptions.SourcePath, snapshot)
+		if err != nil {
+			return
+		}
+		snapshot = current
+
+		printWatchStatus(iteration, changed, reloadSources(buildOptions))
+	}
+}
+
+// waitForChanges function waits until .go files of the source tree changed and then stayed unchanged for the
+// debounce delay. It returns the changed files and the snapshot of the sources then, or the error of the context.
+func waitForChanges(ctx context.Context, sourcePath string, snapshot map[string]time.Time,
+) ([]string, map[string]time.Time, error) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var lastChange time.Time
+	current := snapshot
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		scanned, err := scanSources(sourcePath)
+		if err != nil {
+			continue
+		}
+		if len(changedSources(current, scanned)) > 0 {
+			lastChange = time.Now()
+			current = scanned
+			continue
+		}
+		if !lastChange.IsZero() && time.Since(lastChange) >= watchDebounce {
+			return changedSources(snapshot, current), current, nil
+		}
+	}
+}
+
+// reloadSources function rebuilds the debugged binary and reloads it in the debug pod, and returns the status of
+// the iteration.
+func reloadSources(buildOptions build.Options) string {
+	outputDir, err := os.MkdirTemp("", "trident-debug-watch-")
+	if err != nil {
+		return "cannot create the build directory: " + err.Error()
+	}
+	defer os.RemoveAll(outputDir)
+
+	start := time.Now()
+	binaryPath, err := build.CompileBinary(buildOptions, outputDir)
+	if err != nil {
+		return fmt.Sprintf("build failed, the pod keeps the previous binary: %v", err)
+	}
+	built := time.Since(start)
+
+	start = time.Now()
+	result, err := debug.ReloadSession(binaryPath)
+	if err != nil {
+		return fmt.Sprintf("built in %s, reload failed: %v", built.Round(100*time.Millisecond), err)
+	}
+	return fmt.Sprintf("built in %s, reloaded in %s, %d breakpoints kept, %d discarded",
+		built.Round(100*time.Millisecond), time.Since(start).Round(100*time.Millisecond), result.Kept,
+		result.Discarded)
+}
+
+// printWatchStatus function prints the status line of a watch iteration.
+func printWatchStatus(iteration int, changed []string, status string) {
+	files := strings.Join(changed, ", ")
+	if len(changed) > 3 {
+		files = fmt.Sprintf("%s and %d more", strings.Join(changed[:3], ", "), len(changed)-3)
+	}
+	fmt.Printf("[%s] #%d %s: %s\n", time.Now().Format("15:04:05"), iteration, files, status)
+}
+
+// scanSources function returns the modification time of every .go file of the source tree, by path relative to
+// it. Hidden directories, such as .git, vendored sources and nested modules are skipped.
+func scanSources(sourcePath string) (map[string]time.Time, error) {
+	sources := make(map[string]time.Time)
+	err := filepath.WalkDir(sourcePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == sourcePath {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") || entry.Name() == "vendor" {
+				return filepath.SkipDir
+			}
+			// Nested modules, such as a trident-debug checkout, aren't part of the Trident build.
+			if _, err = os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(entry.Name(), ".go") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The file was removed while walking.
+			return nil
+		}
+		relative, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return err
+		}
+		sources[relative] = info.ModTime()
+		return nil
+	})
+	return sources, err
+}
+
+// changedSources function returns the files added, modified or removed between the snapshots.
+func changedSources(before, after map[string]time.Time) []string {
+	var changed []string
+	for path, modTime := range after {
+		if previous, found := before[path]; !found || !previous.Equal(modTime) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, found := after[path]; !found {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
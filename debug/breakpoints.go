@@ -0,0 +1,269 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	// resumeCheckInterval is how often the tracepoint pump checks whether a stopped process has been resumed.
+	resumeCheckInterval = 500 * time.Millisecond
+)
+
+// BreakpointSpec describes a breakpoint or tracepoint of a breakpoints file. The location is either given as
+// a dlv location expression, e.g. `csi.(*Plugin).CreateVolume` or `core/orchestrator_core.go:123`, or by its
+// file and line, or by its function.
+type BreakpointSpec struct {
+	Location string `yaml:"location"`
+	File     string `yaml:"file"`
+	Line     int    `yaml:"line"`
+	Function string `yaml:"function"`
+	// Condition is a Go expression the breakpoint only stops on when true.
+	Condition string `yaml:"condition"`
+	// HitCount is a hit count condition, e.g. "> 3" or "% 2", a bare number N meaning ">= N".
+	HitCount string `yaml:"hitCount"`
+	// Trace makes the breakpoint a tracepoint, which logs and resumes instead of stopping.
+	Trace bool `yaml:"trace"`
+	// Log lists the expressions evaluated and printed at every hit.
+	Log []string `yaml:"log"`
+}
+
+// breakpointFile is the layout of a breakpoints file.
+type breakpointFile struct {
+	Breakpoints []BreakpointSpec `yaml:"breakpoints"`
+}
+
+// ReadBreakpointFile function reads and validates a YAML breakpoints file.
+func ReadBreakpointFile(path string) ([]BreakpointSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file breakpointFile
+	if err = yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("cannot parse the breakpoints file %s: %v", path, err)
+	}
+
+	for i := range file.Breakpoints {
+		if file.Breakpoints[i].locationExpression() == "" {
+			return nil, fmt.Errorf("breakpoint %d of %s has no location", i+1, path)
+		}
+		if _, err = file.Breakpoints[i].hitCondition(); err != nil {
+			return nil, fmt.Errorf("breakpoint %d of %s: %v", i+1, path, err)
+		}
+	}
+
+	return file.Breakpoints, nil
+}
+
+// locationExpression returns the dlv location expression of the breakpoint.
+func (s *BreakpointSpec) locationExpression() string {
+	switch {
+	case s.Location != "":
+		return s.Location
+	case s.File != "" && s.Line > 0:
+		return fmt.Sprintf("%s:%d", s.File, s.Line)
+	default:
+		return s.Function
+	}
+}
+
+// hitCondition returns the dlv hit condition of the breakpoint.
+func (s *BreakpointSpec) hitCondition() (string, error) {
+	hitCount := strings.TrimSpace(s.HitCount)
+	if hitCount == "" {
+		return "", nil
+	}
+	if _, err := strconv.Atoi(hitCount); err == nil {
+		return ">= " + hitCount, nil
+	}
+	for _, operator := range []string{">=", "<=", "==", "!=", ">", "<", "%"} {
+		if strings.HasPrefix(hitCount, operator) {
+			if _, err := strconv.Atoi(strings.TrimSpace(hitCount[len(operator):])); err == nil {
+				return hitCount, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("invalid hit count %q", s.HitCount)
+}
+
+// breakpoint returns the dlv breakpoint described by the spec.
+func (s *BreakpointSpec) breakpoint() *dlv.Breakpoint {
+	hitCondition, _ := s.hitCondition()
+	bp := &dlv.Breakpoint{
+		Cond:       s.Condition,
+		HitCond:    hitCondition,
+		Tracepoint: s.Trace,
+		Variables:  s.Log,
+	}
+	if s.Trace {
+		bp.LoadArgs = &dlv.DefaultLoadConfig
+	}
+	return bp
+}
+
+// applyBreakpoints function sets the breakpoints through the dlv client of the halted process, and reports the
+// ones which couldn't be set, typically because their location doesn't resolve against the debug binary. It
+// returns whether any tracepoint was set.
+func applyBreakpoints(dlvClient *dlv.Client, specs []BreakpointSpec) bool {
+	tracepoints := false
+	var failed []string
+
+	for i := range specs {
+		location := specs[i].locationExpression()
+		created, err := dlvClient.CreateBreakpoint(specs[i].breakpoint(), location)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", location, err))
+			continue
+		}
+		if len(created.Addrs) == 0 {
+			// dlv keeps a breakpoint without any address for locations which don't resolve yet.
+			_, _ = dlvClient.ClearBreakpoint(created.ID)
+			failed = append(failed, fmt.Sprintf("%s: location not found", location))
+			continue
+		}
+		kind := "Breakpoint"
+		if created.Tracepoint {
+			kind = "Tracepoint"
+			tracepoints = true
+		}
+		fmt.Printf("%s %d set at %s:%d (%s)\n", kind, created.ID, created.File, created.Line, location)
+	}
+
+	if len(failed) > 0 {
+		fmt.Printf("%d of %d breakpoints couldn't be set:\n", len(failed), len(specs))
+		for _, failure := range failed {
+			fmt.Println("  " + failure)
+		}
+	}
+
+	return tracepoints
+}
+
+// breakpointApplier applies the breakpoints of the session every time the port-forward to dlv is ready, as a
+// replaced pod comes with a fresh dlv. When tracepoints are set, it keeps resuming the process after each of
+// their hits. The port-forward supervisor and a reload of the session both use it, so its connection is guarded by
+// its own lock.
+type breakpointApplier struct {
+	sync.Mutex
+	specs     []BreakpointSpec
+	dlvClient *dlv.Client
+	cancel    context.CancelFunc
+}
+
+// apply function connects to dlv on the local port and sets the breakpoints, dropping the previous connection.
+func (a *breakpointApplier) apply(localPort int) {
+	a.Lock()
+	defer a.Unlock()
+	a.disconnect()
+
+	dlvClient, err := dlv.NewClient(net.JoinHostPort(localhost, strconv.Itoa(localPort)))
+	if err != nil {
+		fmt.Println("Cannot connect to dlv to set the breakpoints:", err)
+		return
+	}
+	a.dlvClient = dlvClient
+
+	halted, err := dlvClient.HaltIfRunning()
+	if err != nil {
+		fmt.Println("An error occurred during setting the breakpoints:", err)
+		return
+	}
+	if applyBreakpoints(dlvClient, a.specs) {
+		var ctx context.Context
+		ctx, a.cancel = context.WithCancel(context.Background())
+		go pumpTracepoints(ctx, dlvClient, halted, printTracepointHit)
+	} else if halted {
+		dlvClient.ContinueAsync()
+	}
+}
+
+// close function stops resuming tracepoints and drops the connection to dlv.
+func (a *breakpointApplier) close() {
+	a.Lock()
+	defer a.Unlock()
+	a.disconnect()
+}
+
+// disconnect function is close for callers holding the lock.
+func (a *breakpointApplier) disconnect() {
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+	if a.dlvClient != nil {
+		_ = a.dlvClient.Close()
+		a.dlvClient = nil
+	}
+}
+
+// pumpTracepoints function resumes the process every time it stops only because of tracepoints, reporting
+// every hit. Stops for other reasons, such as a breakpoint hit by a debugger, are left alone until the process
+// is resumed by whoever stopped it. A process the caller halted is resumed first, when resume is set. It returns
+// once the context is canceled or the connection is lost.
+// The process is resumed through the pump whenever possible, as only the state returned by a resuming command
+// carries the arguments and variables of the tracepoint hits.
+func pumpTracepoints(ctx context.Context, dlvClient *dlv.Client, resume bool, onHit func(*dlv.Thread)) {
+	var state *dlv.DebuggerState
+	var err error
+	if resume {
+		state, err = dlvClient.Continue()
+	} else {
+		state, err = dlvClient.WaitForStop()
+	}
+	for err == nil && ctx.Err() == nil && !state.Exited {
+		if dlv.StoppedAtTracepointsOnly(state) {
+			for _, thread := range state.Threads {
+				if thread.Breakpoint != nil {
+					onHit(thread)
+				}
+			}
+			state, err = dlvClient.Continue()
+			continue
+		}
+
+		// Waiting for whoever stopped the process to resume it.
+		for err == nil && ctx.Err() == nil && !state.Running && !state.Exited {
+			time.Sleep(resumeCheckInterval)
+			state, err = dlvClient.State()
+		}
+		if err == nil && ctx.Err() == nil && !state.Exited {
+			state, err = dlvClient.WaitForStop()
+		}
+	}
+}
+
+// printTracepointHit function prints the function, arguments and log expressions of a tracepoint hit.
+func printTracepointHit(thread *dlv.Thread) {
+	function := "?"
+	if thread.Function != nil {
+		function = thread.Function.Name
+	}
+
+	var arguments, variables []string
+	if info := thread.BreakpointInfo; info != nil {
+		for i := range info.Arguments {
+			arguments = append(arguments, info.Arguments[i].Name+"="+dlv.FormatVariable(&info.Arguments[i]))
+		}
+		for i := range info.Variables {
+			variables = append(variables, info.Variables[i].Name+" = "+dlv.FormatVariable(&info.Variables[i]))
+		}
+	}
+
+	fmt.Printf("> [Tracepoint %d] goroutine %d %s(%s) %s:%d\n", thread.Breakpoint.ID, thread.GoroutineID,
+		function, strings.Join(arguments, ", "), thread.File, thread.Line)
+	for _, variable := range variables {
+		fmt.Println("    " + variable)
+	}
+}
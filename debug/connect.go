@@ -0,0 +1,75 @@
+package debug
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+// ConnectDlv function connects to the dlv server of a debug session. Given an address, such as the local
+// port-forward of a running session, dlv is reached directly. Otherwise a port-forward to the debug pod of the
+// target is opened for the connection. The returned function closes the connection and the port-forward.
+func ConnectDlv(opts Options, address string) (*dlv.Client, func(), error) {
+	if address != "" {
+		dlvClient, err := dlv.NewClient(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		return dlvClient, func() { _ = dlvClient.Close() }, nil
+	}
+
+	if err := initSession(opts); err != nil {
+		return nil, nil, err
+	}
+
+	_, dlvClient, closeClient, err := connectDebugPod()
+	return dlvClient, closeClient, err
+}
+
+// connectDebugPod function finds the running debug pod of the target and connects to its dlv server through a
+// port-forward. Only the JSON-RPC server can be connected to, a pod running the DAP server is refused. The returned
+// function closes the connection and the port-forward.
+func connectDebugPod() (*corev1.Pod, *dlv.Client, func(), error) {
+	label, containerName := targetWorkload()
+	pod, err := findRunningDebugPod(label, options.NodeName, containerName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if pod == nil {
+		return nil, nil, nil, fmt.Errorf("no running %s debug pod found, please start a debug session first",
+			options.Target)
+	}
+	if podRunsDAPServer(pod, containerName) {
+		return nil, nil, nil, fmt.Errorf("trident-debug needs the %s dlv server, the pod %s runs the %s one, "+
+			"connect to it from a DAP client instead", DlvServerRPC, pod.Name, DlvServerDAP)
+	}
+
+	if dlvPort, err = podDlvPort(pod, containerName); err != nil {
+		return nil, nil, nil, err
+	}
+
+	pfStop, pfErr, localPort, err := startPortForwarding(pod, options.LocalPort)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stopForwarding := func() {
+		close(pfStop)
+		<-pfErr
+	}
+
+	dlvClient, err := dlv.NewClient(net.JoinHostPort(localhost, strconv.Itoa(localPort)))
+	if err != nil {
+		stopForwarding()
+		return nil, nil, nil, err
+	}
+	fmt.Printf("Connected to dlv in the pod %s through localhost:%d\n", pod.Name, localPort)
+
+	return pod, dlvClient, func() {
+		_ = dlvClient.Close()
+		stopForwarding()
+	}, nil
+}
@@ -0,0 +1,136 @@
+package debug
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	// busyboxBinary is shipped in the debug images to copy files in and out of the debug pod through exec.
+	busyboxBinary = "/bin/busybox"
+	// podCoreDirectory is where dlv writes core dumps in the debug pod.
+	podCoreDirectory = "/tmp"
+	coreFileName     = "core"
+	dumpWaitInterval = time.Second
+)
+
+// CaptureCore function makes the dlv server of the target's debug pod write a core dump of the debugged process,
+// and downloads it into the output directory, along with the debug binary, so that it can be opened offline
+// with `dlv core`. The process is halted while the dump is written. It returns the local paths of the core dump
+// and of the binary.
+func CaptureCore(opts Options, outputDirectory string) (corePath, binaryPath string, err error) {
+	if err = initSession(opts); err != nil {
+		return "", "", err
+	}
+
+	pod, dlvClient, closeClient, err := connectDebugPod()
+	if err != nil {
+		return "", "", err
+	}
+	defer closeClient()
+	_, containerName := targetWorkload()
+
+	if outputDirectory == "" {
+		outputDirectory = fmt.Sprintf("core-%s-%s", options.Target, time.Now().Format("20060102-150405"))
+	}
+	if err = os.MkdirAll(outputDirectory, 0755); err != nil {
+		return "", "", fmt.Errorf("cannot create the directory %s: %v", outputDirectory, err)
+	}
+
+	podCorePath := path.Join(podCoreDirectory, fmt.Sprintf("trident-debug-%d.core", time.Now().Unix()))
+	// The core dump is removed from the pod whatever happens, it is as large as the process memory.
+	defer func() {
+		if err := client.KubeClient.ExecInPod(pod, containerName, []string{busyboxBinary, "rm", "-f", podCorePath},
+			nil, nil); err != nil {
+			fmt.Printf("Cannot remove %s from the pod %s: %v\n", podCorePath, pod.Name, err)
+		}
+	}()
+
+	fmt.Println("Writing the core dump, the process is halted meanwhile...")
+	if err = dumpCore(dlvClient, podCorePath); err != nil {
+		return "", "", err
+	}
+
+	fmt.Printf("Downloading the core dump from the pod %s...\n", pod.Name)
+	corePath = filepath.Join(outputDirectory, coreFileName)
+	if err = copyFromPod(pod, containerName, podCorePath, corePath); err != nil {
+		return "", "", err
+	}
+
+	binary := podDebuggedBinary(pod, containerName)
+	fmt.Printf("Downloading the debug binary %s from the pod %s...\n", binary, pod.Name)
+	binaryPath = filepath.Join(outputDirectory, path.Base(binary))
+	if err = copyFromPod(pod, containerName, binary, binaryPath); err != nil {
+		return "", "", err
+	}
+
+	return corePath, binaryPath, nil
+}
+
+// dumpCore function writes a core dump of the halted process to the path in the pod, and waits for it to finish.
+func dumpCore(dlvClient *dlv.Client, podCorePath string) error {
+	return dlvClient.WithHalted(func() error {
+		state, err := dlvClient.DumpStart(podCorePath)
+		for err == nil && state.Dumping && state.Err == "" {
+			if state.MemTotal > 0 {
+				fmt.Printf("  %d/%d threads, %d/%d MiB\n", state.ThreadsDone, state.ThreadsTotal,
+					state.MemDone>>20, state.MemTotal>>20)
+			}
+			state, err = dlvClient.DumpWait(dumpWaitInterval)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write the core dump: %v", err)
+		}
+		if state.Err != "" {
+			return fmt.Errorf("cannot write the core dump: %s", state.Err)
+		}
+		return nil
+	})
+}
+
+// copyFromPod function copies a file of the pod's container to the local path.
+func copyFromPod(pod *corev1.Pod, containerName, podPath, localPath string) error {
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	err = client.KubeClient.ExecInPod(pod, containerName, []string{busyboxBinary, "cat", podPath}, nil, file)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("cannot copy %s out of the pod %s: %v", podPath, pod.Name, err)
+	}
+	return file.Close()
+}
+
+// podDebuggedBinary function returns the binary dlv runs in the container of the pod.
+func podDebuggedBinary(pod *corev1.Pod, containerName string) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != containerName {
+			continue
+		}
+		for i, arg := range container.Args {
+			if arg == "exec" && i+1 < len(container.Args) {
+				return container.Args[i+1]
+			}
+		}
+	}
+	return targetBinary()
+}
+
+// podRunsDAPServer function tells whether dlv serves DAP rather than JSON-RPC in the container of the pod.
+func podRunsDAPServer(pod *corev1.Pod, containerName string) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == containerName {
+			return len(container.Args) > 0 && container.Args[0] == "dap"
+		}
+	}
+	return false
+}
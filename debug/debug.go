@@ -2,242 +2,595 @@ package debug
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// pollInterval is how often the cluster is polled while waiting for the workload.
+	pollInterval = 500 * time.Millisecond
+	// rolloutTimeout bounds every wait on the workload, so that a pod that never comes up, or never goes away,
+	// fails the session, which then reverts the workload.
+	rolloutTimeout = 10 * time.Minute
 )
 
 var (
 	tridentControllerDeploymentName = "trident-controller"
 	tridentDeploymentMainContainer  = "trident-main"
+	tridentOperatorDeploymentName   = "trident-operator"
+	tridentOperatorContainer        = "trident-operator"
+
+	tridentOrchestratorBin = "/trident_orchestrator"
+	tridentOperatorBin     = "/trident-operator"
+
+	dlvBinary    = "/dlv"
+	dlvListenArg = "--listen="
+
+	// dlvListeningMessage is logged by dlv once its JSON-RPC server accepts connections.
+	dlvListeningMessage = "API server listening at"
+	// dlvDAPListeningMessage is logged by dlv once its DAP server accepts connections.
+	dlvDAPListeningMessage = "DAP server listening at"
+
+	// debuggedCommand is the command line of the debugged binary, as the container ran it before being modified.
+	debuggedCommand []string
+
+	// dlvPort is the port dlv listens on inside the debug pod, settled when the container is modified.
+	dlvPort = int32(DefaultRemotePort)
 )
 
-// getTridentDeployment function is used to get the trident deployment object from the kubernetes cluster.
-// It then modifies the deployment object to add the dlv debugger to the trident-main container.
+// getTridentDeployment function is used to get the named deployment object from the kubernetes cluster.
+// It then modifies the deployment object to add the dlv debugger to the given container.
 // And deploy the updated deployment object to the kubernetes cluster.
-func getTridentDeployment(ctx context.Context) (err error) {
-
-	// Extracting the deploymentChan from the context
-	deploymentChan := ctx.Value("deploymentChan").(chan int)
+// The label is used to find the pod of the updated deployment.
+func getTridentDeployment(ctx context.Context, deploymentName, containerName, label string) (err error) {
 
 	deploymentSet := client.KubeClient.GetDeployment()
-	tridentDeployment, err := deploymentSet.Get(context.TODO(), tridentControllerDeploymentName, metav1.GetOptions{})
-	fmt.Printf("Found deployment %s in namespace %s\n", tridentDeployment.Name, tridentDeployment.Namespace)
-
-	// Writing the deployment object to a yaml file, in copy_directory
-	specYaml, err := yaml.Marshal(tridentDeployment.Spec)
+	tridentDeployment, err := deploymentSet.Get(context.TODO(), deploymentName, metav1.GetOptions{})
 	if err != nil {
-		fmt.Println("An error occurred:", err)
-		return
+		return err
 	}
-	err = os.WriteFile("copy_directory/trident-controller-deployment.yaml", specYaml, 0644)
-	if err != nil {
-		fmt.Println("An error occurred during writing trident-controller-deployment onto a yaml:", err)
+	fmt.Printf("Found deployment %s in namespace %s\n", tridentDeployment.Name, tridentDeployment.Namespace)
+
+	// Modifying a debugged deployment again would stack the debugger onto the other session's.
+	if existing := findExistingSession(kindDeployment, tridentDeployment.ObjectMeta,
+		&tridentDeployment.Spec.Template.Spec, containerName); existing != nil {
+		proceed, err := resolveExistingSession(existing)
+		if err != nil || !proceed {
+			return err
+		}
+		if tridentDeployment, err = deploymentSet.Get(context.TODO(), deploymentName, metav1.GetOptions{}); err != nil {
+			return err
+		}
 	}
 
 	// Making a copy of the deployment object
 	tridentDeploymentCopy := tridentDeployment.DeepCopy()
-	for i, container := range tridentDeploymentCopy.Spec.Template.Spec.Containers {
-		// If the container name matches the trident-main container
-		if container.Name == tridentDeploymentMainContainer {
-			// Get the container.
-			tridentMainContainer := &tridentDeploymentCopy.Spec.Template.Spec.Containers[i]
-
-			// Inserting `dlv` args at the beginning of existing args.
-			argsCopy := tridentMainContainer.Args
-			index := 0
-			argsCopy = append(argsCopy[:index+1], argsCopy[index:]...)
-			argsCopy[index] = "--"
-			delveArgs := []string{"--listen=:40000",
-				"--headless=true",
-				"--continue",
-				"--api-version=2",
-				"--accept-multiclient",
-				"exec",
-			}
-			args := append(delveArgs, tridentMainContainer.Command...)
-			args = append(args, argsCopy...)
-			tridentMainContainer.Args = args
-
-			// Change the command to dlv.
-			tridentMainContainer.Command = []string{"/dlv"}
-
-			// Adding port 40000 to the container on which dlv is exposed.
-			containerPorts := tridentMainContainer.Ports
-			containerPorts = append(containerPorts, corev1.ContainerPort{
-				ContainerPort: 40000,
-				Protocol:      "TCP",
-			})
-			tridentMainContainer.Ports = containerPorts
-
-			// Changing the image of the `trident-main` container
-			// for ex: artifactory_namespace = pshashan and artifactory_folder = trident-debug
-			// the image will be `docker.repo.eng.netapp.com/pshashan/trident-debug:latest`
-			// if artifactory_folder is empty, the image will be `docker.repo.eng.netapp.com/pshashan/trident-debug:latest`
-			if artifactoryFolder != "" {
-				tridentMainContainer.Image = "docker.repo.eng.netapp.com" + "/" + artifactoryNamespace + "/" + artifactoryFolder + "/trident-debug:latest"
-			} else {
-				tridentMainContainer.Image = "docker.repo.eng.netapp.com" + "/" + artifactoryNamespace + "/trident-debug:latest"
-			}
-			tridentMainContainer.ImagePullPolicy = corev1.PullAlways
-
-			// Adding SYS_PTRACE capability to the container
-			tridentMainContainer.SecurityContext = &corev1.SecurityContext{
-				Capabilities: &corev1.Capabilities{
-					Add: []corev1.Capability{"SYS_PTRACE"},
-				},
-				RunAsNonRoot: func(b bool) *bool { return &b }(false),
-			}
+	if err = addDebuggerToContainer(&tridentDeploymentCopy.Spec.Template.Spec, containerName); err != nil {
+		return err
+	}
 
-			break
-		}
+	// The session is recorded before the deployment is modified, so that it can be restored by another process.
+	state, err := newSessionState(kindDeployment, deploymentName, tridentDeployment)
+	if err != nil {
+		return err
+	}
+	state.Mutations = debuggerMutations(kindDeployment, deploymentName, containerName)
+	annotations := sessionAnnotations(state, containerImage(&tridentDeployment.Spec.Template.Spec, containerName))
+	annotate(&tridentDeploymentCopy.ObjectMeta, annotations)
+	annotate(&tridentDeploymentCopy.Spec.Template.ObjectMeta, annotations)
+	if err = state.save(); err != nil {
+		return fmt.Errorf("cannot record the session: %v", err)
 	}
 
 	_, err = deploymentSet.Update(context.TODO(), tridentDeploymentCopy, metav1.UpdateOptions{})
 	if err != nil {
+		state.remove()
 		return err
 	}
 
+	// From here on the deployment is modified, so it has to be reverted whatever happens.
+	defer func() {
+		revertErr := revertTridentDeployment(client, tridentDeployment, state.ID)
+		if revertErr != nil {
+			state.keep()
+			if err == nil {
+				err = revertErr
+			}
+			return
+		}
+		state.remove()
+	}()
+
 	fmt.Println("Sleeping for 10 seconds, so that cache is updated...")
-	time.Sleep(10 * time.Second)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(10 * time.Second):
+	}
 
 	// Checking if the deployment is updated successfully.
+	// A halted trident never becomes ready, so in that case only the pod itself is waited for.
 	fmt.Println("Checking if the deployment is updated successfully...")
 	deploymentSet = client.KubeClient.GetDeployment()
-	for {
-		deployment, _ := deploymentSet.Get(context.TODO(), tridentControllerDeploymentName, metav1.GetOptions{})
-		if deployment.Status.ReadyReplicas == deployment.Status.Replicas {
-			break
+	if !startsHalted() {
+		err = pollUntil(ctx, "the deployment "+deploymentName, func(ctx context.Context) (bool, error) {
+			deployment, err := deploymentSet.Get(ctx, deploymentName, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			if deployment.Status.ReadyReplicas == deployment.Status.Replicas {
+				return true, nil
+			}
+			fmt.Println("Waiting for the deployment to be updated...")
+			return false, nil
+		})
+		if err != nil {
+			return err
 		}
-		fmt.Println("Waiting for the deployment to be updated...")
-		time.Sleep(500 * time.Millisecond)
 	}
 
-	pod, err := client.KubeClient.GetPodByLabel(TridentCSILabel, false)
-	if err != nil {
+	if _, err = waitForDebugPod(ctx, label, "", containerName); err != nil {
 		return err
 	}
-	for {
-		allContainersReady := true
-		for _, containerStatus := range pod.Status.ContainerStatuses {
-			if containerStatus.State.Running == nil {
-				allContainersReady = false
-				break
-			}
-		}
-		if allContainersReady {
-			fmt.Println("All containers in the pod are ready")
-			break
-		}
-		fmt.Println("Waiting for all containers to be ready...")
-		time.Sleep(500 * time.Millisecond)
-	}
 	fmt.Println("Deployment updated successfully.")
 
-	//fmt.Println("Starting port-forwarding to the trident-main...")
-	//err, _, stopChan := startPortForwarding(pod)
-	//if err != nil {
-	//	fmt.Println("An error occurred during port-forwarding:", err)
-	//	deploymentChan <- 1 // Signaling that the deployment has been updated and containers are up and running.
-	//	fmt.Println("Reverting the changes made to the deployment...")
-	//	// Get the latest version of the deployment
-	//	latestTridentDeployment, _ := deploymentSet.Get(context.TODO(), tridentControllerDeploymentName, metav1.GetOptions{})
-	//
-	//	// Reverting the changes made to the deployment.
-	//	latestTridentDeployment.Spec = tridentDeployment.Spec
-	//	// Updating the deployment with the original spec.
-	//	_, _ = deploymentSet.Update(context.TODO(), latestTridentDeployment, metav1.UpdateOptions{})
-	//	return err
-	//}
-
-	//fmt.Println("Port-forwarding is ready at the port 40000")
+	return runDebugSession(ctx, label, "", containerName)
+}
+
+// runDebugSession function forwards the dlv port of the debug pod, signals that the session is ready and
+// waits until the context is canceled. The port-forward is stopped before returning, so that it is gone by the
+// time the workload is reverted.
+func runDebugSession(ctx context.Context, label, nodeName, containerName string) error {
+
+	// Extracting the deploymentChan from the context
+	deploymentChan := ctx.Value("deploymentChan").(chan int)
+
+	// The breakpoints are set through dlv's JSON-RPC API every time the forward is ready.
+	var onReady func(localPort int)
+	applier := &breakpointApplier{specs: options.Breakpoints}
+	if len(options.Breakpoints) > 0 && options.DlvServer == DlvServerRPC {
+		onReady = applier.apply
+	}
+
+	fmt.Println("Starting port-forwarding to the debug pod...")
+	forwarder, err := startSupervisedPortForwarding(label, nodeName, containerName, onReady)
+	if err != nil {
+		fmt.Println("An error occurred during port-forwarding:", err)
+		return err
+	}
+	fmt.Printf("Port-forwarding is ready at localhost:%d -> %d\n", forwarder.localPort, dlvPort)
+
+	printIDEConfigurations(forwarder.localPort)
+
+	session.Lock()
+	session.applier, session.localPort = applier, forwarder.localPort
+	session.Unlock()
 
 	deploymentChan <- 1 // Signaling that the deployment has been updated and containers are up and running.
 
 	<-ctx.Done() // Waiting for the context to be canceled.
 
-	//// Stopping the port-forwarding
-	//fmt.Println("Stopping the port-forwarding...")
-	//stopChan <- struct{}{}
+	// Stopping the port-forwarding
+	fmt.Println("Stopping the port-forwarding...")
+	session.Lock()
+	session.applier = nil
+	session.Unlock()
+	forwarder.stop()
+	applier.close()
+
+	return nil
+}
 
+// revertTridentDeployment function restores the spec of the deployment to the original one, unless another
+// session took the deployment over from the session.
+func revertTridentDeployment(clients *Clients, tridentDeployment *appsv1.Deployment, sessionID string) error {
 	// Reverting the changes made to the deployment
 	fmt.Println("Reverting the changes made to the deployment...")
+	deploymentSet := clients.KubeClient.GetDeployment()
 	// Get the latest version of the deployment
-	latestTridentDeployment, err := deploymentSet.Get(context.TODO(), tridentControllerDeploymentName, metav1.GetOptions{})
+	latestTridentDeployment, err := deploymentSet.Get(context.TODO(), tridentDeployment.Name, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
+	if !ownedBySession(kindDeployment, latestTridentDeployment.ObjectMeta, sessionID) {
+		return nil
+	}
 	// Reverting the changes made to the deployment.
 	latestTridentDeployment.Spec = tridentDeployment.Spec
+	removeSessionAnnotations(&latestTridentDeployment.ObjectMeta)
 	// Updating the deployment with the original spec.
 	_, err = deploymentSet.Update(context.TODO(), latestTridentDeployment, metav1.UpdateOptions{})
 
 	return err
 }
 
-// startPortForwarding function is used to start port forwarding to the trident-main container.
-func startPortForwarding(pod *corev1.Pod) (error, chan struct{}, chan struct{}) {
+// addDebuggerToContainer function modifies the named container of the pod spec, so that it runs under dlv.
+// The container command is wrapped by dlv, the dlv port is exposed, the image is switched to the debug image
+// and the SYS_PTRACE capability is added to the container's security context.
+func addDebuggerToContainer(podSpec *corev1.PodSpec, containerName string) error {
+	for i, container := range podSpec.Containers {
+		// If the container name matches the given container
+		if container.Name != containerName {
+			continue
+		}
 
-	if pod.Status.Phase != corev1.PodRunning {
-		return fmt.Errorf("pod not running: %s", pod.Name), nil, nil
-	}
+		port, err := resolveDlvPort(podSpec)
+		if err != nil {
+			return err
+		}
+		dlvPort = port
+		// Get the container.
+		mainContainer := &podSpec.Containers[i]
+
+		// The container may rely on the image entrypoint, in which case the binary is named explicitly.
+		command := mainContainer.Command
+		if len(command) == 0 {
+			command = []string{targetBinary()}
+		}
+		debuggedCommand = append(append([]string{}, command...), mainContainer.Args...)
 
-	// URL to the pod's portforward endpoint
-	// e.g., http://localhost:8080/api/v1/namespaces/default/pods/pod-name/portforward
+		if startsHalted() {
+			// Kubernetes would otherwise kill the halted process for failing its probes.
+			mainContainer.LivenessProbe = nil
+			mainContainer.ReadinessProbe = nil
+			mainContainer.StartupProbe = nil
+		}
 
-	url := client.KubeClient.clientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Namespace(pod.Namespace).
-		Name(pod.Name).
-		SubResource("portforward").URL()
+		if options.DlvServer == DlvServerDAP {
+			// The DAP server launches trident itself, once the editor sends its launch request.
+			mainContainer.Args = []string{"dap", fmt.Sprintf("%s:%d", dlvListenArg, dlvPort)}
+		} else {
+			// Inserting `dlv` args at the beginning of existing args.
+			argsCopy := append([]string{"--"}, mainContainer.Args...)
+			delveArgs := []string{fmt.Sprintf("%s:%d", dlvListenArg, dlvPort),
+				"--headless=true",
+				"--continue",
+				"--api-version=2",
+				"--accept-multiclient",
+				"exec",
+			}
+			if options.WaitForAttach {
+				// The restarted trident then stays at its entry point until a debugger attaches and continues it.
+				delveArgs = removeArg(delveArgs, "--continue")
+			}
+			args := append(delveArgs, command...)
+			args = append(args, argsCopy...)
+			mainContainer.Args = args
+		}
 
-	transport, upgrader, err := spdy.RoundTripperFor(client.RestConfig)
-	if err != nil {
-		return err, nil, nil
+		// Change the command to dlv.
+		mainContainer.Command = []string{dlvBinary}
+
+		// Adding the port to the container on which dlv is exposed.
+		containerPorts := mainContainer.Ports
+		containerPorts = append(containerPorts, corev1.ContainerPort{
+			ContainerPort: dlvPort,
+			Protocol:      "TCP",
+		})
+		mainContainer.Ports = containerPorts
+
+		mainContainer.Image = options.Image
+		mainContainer.ImagePullPolicy = corev1.PullAlways
+		if options.LocalImage {
+			mainContainer.ImagePullPolicy = corev1.PullIfNotPresent
+		}
+
+		// In a cluster of mixed architectures, the pod could otherwise be scheduled where the image can't run.
+		if options.Arch != "" {
+			if podSpec.NodeSelector == nil {
+				podSpec.NodeSelector = make(map[string]string)
+			}
+			podSpec.NodeSelector[NodeArchLabel] = options.Arch
+		}
+
+		// Adding SYS_PTRACE capability to the container, keeping whatever else the security context
+		// already grants (the node plugin, for example, has to stay privileged).
+		if mainContainer.SecurityContext == nil {
+			mainContainer.SecurityContext = &corev1.SecurityContext{}
+		}
+		if mainContainer.SecurityContext.Capabilities == nil {
+			mainContainer.SecurityContext.Capabilities = &corev1.Capabilities{}
+		}
+		mainContainer.SecurityContext.Capabilities.Add = append(mainContainer.SecurityContext.Capabilities.Add,
+			"SYS_PTRACE")
+		mainContainer.SecurityContext.RunAsNonRoot = func(b bool) *bool { return &b }(false)
+
+		return nil
 	}
 
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+	return fmt.Errorf("cannot find the container %s", containerName)
+}
 
-	// Set local and remote ports
-	localPort := "40000"
-	remotePort := "40000"
+// resolveDlvPort function returns the port dlv listens on in the pod. If a container of the pod already
+// declares the requested port, the request is refused when the port was chosen by the user, otherwise the next
+// undeclared port is used instead.
+func resolveDlvPort(podSpec *corev1.PodSpec) (int32, error) {
+	declared := make(map[int32]string)
+	for _, container := range podSpec.Containers {
+		for _, port := range container.Ports {
+			declared[port.ContainerPort] = container.Name
+		}
+	}
 
-	ports := []string{fmt.Sprintf("%s:%s", localPort, remotePort)}
+	port := int32(options.RemotePort)
+	if containerName, ok := declared[port]; ok {
+		if options.RemotePortSet {
+			return 0, fmt.Errorf("port %d is already declared by the container %s, please choose another "+
+				"remote port", port, containerName)
+		}
+		for declared[port] != "" {
+			port++
+		}
+		fmt.Printf("Port %d is already declared by the container %s, dlv will listen on %d instead\n",
+			options.RemotePort, containerName, port)
+	}
 
-	readyChan := make(chan struct{}, 1)
-	stopChan := make(chan struct{}, 1)
+	return port, nil
+}
 
-	// Create a file to write the output
-	outFile, err := os.Create("portforward_output.txt")
-	if err != nil {
-		return err, nil, nil
+// targetBinary returns the path of the debugged binary inside the debug image.
+func targetBinary() string {
+	if options.Target == TargetOperator {
+		return tridentOperatorBin
 	}
+	return tridentOrchestratorBin
+}
 
-	// Create a file to write the error
-	errFile, err := os.Create("portforward_error.txt")
+// waitForPodContainersRunning function waits until a pod matching the label, and scheduled on the given node
+// if nodeName isn't empty, runs the debug image in the named container and all of its containers are running.
+// It returns the running pod.
+func waitForPodContainersRunning(ctx context.Context, label, nodeName, containerName string) (*corev1.Pod, error) {
+	var pod *corev1.Pod
+	err := pollUntil(ctx, "the debug pod", func(context.Context) (bool, error) {
+		var err error
+		if pod, err = findRunningDebugPod(label, nodeName, containerName); err != nil {
+			return false, err
+		}
+		if pod == nil {
+			fmt.Println("Waiting for all containers to be ready...")
+			return false, nil
+		}
+		return true, nil
+	})
 	if err != nil {
-		return err, nil, nil
+		return nil, err
 	}
+	fmt.Printf("All containers in the pod %s are ready\n", pod.Name)
+	return pod, nil
+}
 
-	pf, err := portforward.New(dialer, ports, readyChan, stopChan, outFile, errFile)
+// waitForDebugPod function waits until the debug pod is ready to be debugged, and returns it.
+// When trident waits for a debugger to attach or is launched by the DAP server, the pod is ready once dlv is
+// listening, otherwise once all of its containers are running.
+func waitForDebugPod(ctx context.Context, label, nodeName, containerName string) (*corev1.Pod, error) {
+	pod, err := waitForPodContainersRunning(ctx, label, nodeName, containerName)
 	if err != nil {
-		return err, nil, nil
+		return nil, err
+	}
+	if err = verifyImageDigest(pod, containerName); err != nil {
+		return nil, err
+	}
+	if !startsHalted() {
+		return pod, nil
 	}
 
-	// Start port forwarding in a separate goroutine
-	go func() {
-		err = pf.ForwardPorts()
+	listeningMessage := dlvListeningMessage
+	if options.DlvServer == DlvServerDAP {
+		listeningMessage = dlvDAPListeningMessage
+	}
+
+	fmt.Println("Waiting for dlv to listen...")
+	err = pollUntil(ctx, "dlv to listen", func(context.Context) (bool, error) {
+		logs, err := client.KubeClient.GetPodLogs(pod, containerName)
 		if err != nil {
-			fmt.Println("An error occurred during port-forwarding:", err)
+			return false, err
 		}
-	}()
+		return strings.Contains(logs, listeningMessage), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if options.DlvServer == DlvServerDAP {
+		fmt.Println("dlv is listening, trident is started once an editor sends its launch request.")
+	} else {
+		fmt.Println("dlv is listening, trident is halted until a debugger attaches and continues it.")
+	}
+	return pod, nil
+}
+
+// pollUntil function polls the condition until it is met, fails, the context is canceled or rolloutTimeout
+// elapses. What is waited for names it in the error.
+func pollUntil(ctx context.Context, what string, condition wait.ConditionWithContextFunc) error {
+	err := wait.PollUntilContextTimeout(ctx, pollInterval, rolloutTimeout, true, condition)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s waiting for %s", rolloutTimeout, what)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("stopped waiting for %s", what)
+	default:
+		return err
+	}
+}
+
+// verifyImageDigest function checks that the debugged container of the pod runs the very image the session
+// pinned by digest, as reported in its status. Nothing is checked for images not pinned by digest.
+func verifyImageDigest(pod *corev1.Pod, containerName string) error {
+	expected := imageDigest(options.Image)
+	if expected == "" {
+		return nil
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != containerName {
+			continue
+		}
+		if actual := imageDigest(status.ImageID); actual != expected {
+			return fmt.Errorf("the container %s of the pod %s runs the image %s with the digest %s, not the "+
+				"pushed digest %s", containerName, pod.Name, status.Image, actual, expected)
+		}
+		fmt.Printf("The pod %s runs the pushed image %s\n", pod.Name, expected)
+		return nil
+	}
+	return fmt.Errorf("cannot find the status of the container %s in the pod %s", containerName, pod.Name)
+}
 
-	return nil, readyChan, stopChan
+// imageDigest function returns the digest of an image reference or image ID, such as
+// `docker-pullable://registry/trident-debug@sha256:...`, or an empty string if it holds none.
+func imageDigest(image string) string {
+	if at := strings.LastIndex(image, "@"); at >= 0 {
+		return image[at+1:]
+	}
+	if strings.HasPrefix(image, "sha256:") {
+		return image
+	}
+	return ""
+}
+
+// findRunningDebugPod function returns the pod matching the label, and scheduled on the given node if nodeName
+// isn't empty, that runs the debug image in the named container and has all of its containers running.
+// It returns nil if there is no such pod yet.
+func findRunningDebugPod(label, nodeName, containerName string) (*corev1.Pod, error) {
+	pods, err := client.KubeClient.GetPodsByLabel(label, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		if nodeName != "" && pod.Spec.NodeName != nodeName {
+			continue
+		}
+		if pod.DeletionTimestamp != nil || len(pod.Status.ContainerStatuses) == 0 {
+			continue
+		}
+		if !runsDebugger(pod, containerName) || !runsSessionImage(pod, containerName) {
+			continue
+		}
+
+		// While trident is halted the sidecars can't reach it, so only the debugged container is checked.
+		// The pod tells whether it is, as another process than the session's doesn't know how it was started.
+		halted := podStartsHalted(pod, containerName)
+		allContainersReady := true
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if halted && containerStatus.Name != containerName {
+				continue
+			}
+			if containerStatus.State.Running == nil {
+				allContainersReady = false
+				break
+			}
+		}
+		if allContainersReady {
+			return pod, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// runsSessionImage function reports whether the named container of the pod was created with the debug image of
+// the session, so that a pod left over by a previous session isn't mistaken for the new one. Any image matches
+// when the session has none, such as when connecting to a running session.
+func runsSessionImage(pod *corev1.Pod, containerName string) bool {
+	if options.Image == "" {
+		return true
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == containerName {
+			return container.Image == options.Image
+		}
+	}
+	return false
+}
+
+// startsHalted function reports whether trident doesn't run until a debugger connects, which is the case when
+// waiting for a debugger to attach and when the DAP server is used.
+func startsHalted() bool {
+	return options.WaitForAttach || options.DlvServer == DlvServerDAP
+}
+
+// podStartsHalted function reports whether the named container of the pod runs trident halted until a debugger
+// connects, which is the case when dlv serves DAP or runs without --continue.
+func podStartsHalted(pod *corev1.Pod, containerName string) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != containerName {
+			continue
+		}
+		if len(container.Args) > 0 && container.Args[0] == "dap" {
+			return true
+		}
+		for _, arg := range container.Args {
+			if arg == "--" {
+				break
+			}
+			if arg == "--continue" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// removeArg function returns the args without the given one.
+func removeArg(args []string, arg string) []string {
+	kept := make([]string, 0, len(args))
+	for _, a := range args {
+		if a != arg {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// runsDebugger function reports whether the named container of the pod runs dlv.
+func runsDebugger(pod *corev1.Pod, containerName string) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == containerName {
+			return len(container.Command) > 0 && container.Command[0] == dlvBinary
+		}
+	}
+	return false
+}
+
+// podDlvPort function returns the port dlv listens on in the named container of the pod, as given by its
+// --listen argument.
+func podDlvPort(pod *corev1.Pod, containerName string) (int32, error) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != containerName {
+			continue
+		}
+		for _, arg := range container.Args {
+			if !strings.HasPrefix(arg, dlvListenArg) {
+				continue
+			}
+			port, err := strconv.ParseInt(arg[strings.LastIndex(arg, ":")+1:], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("cannot parse the dlv argument %s: %v", arg, err)
+			}
+			return int32(port), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot find the dlv port of the container %s in the pod %s", containerName, pod.Name)
+}
+
+// targetWorkload function returns the label of the pods of the target, and the name of their debugged container.
+func targetWorkload() (label, containerName string) {
+	switch options.Target {
+	case TargetNode:
+		return TridentNodeLabel, tridentNodeMainContainer
+	case TargetOperator:
+		return TridentOperatorLabel, tridentOperatorContainer
+	default:
+		return TridentCSILabel, tridentDeploymentMainContainer
+	}
 }
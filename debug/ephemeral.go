@@ -0,0 +1,261 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	ephemeralContainerPrefix = "trident-debug-"
+
+	// findProcessScript finds the process dlv attaches to, then runs the command of its remaining arguments, dlv,
+	// with the PID appended. The ephemeral container shares the process namespace of the debugged container, where
+	// Trident is the first process, unless the pod shares the host's or its own process namespace: Trident is then
+	// told apart by its binary and by the container ID in its cgroup. Its first arguments are the binary and the
+	// container ID.
+	findProcessScript = `binary=$1; container=$2; shift 2
+for process in /proc/[0-9]*; do
+	[ "$(` + busyboxBinary + ` readlink "$process/exe")" = "$binary" ] || continue
+	if [ -n "$container" ]; then
+		` + busyboxBinary + ` grep -q "$container" "$process/cgroup" 2>/dev/null || continue
+	fi
+	exec "$@" "${process#/proc/}"
+done
+echo "cannot find the process of $binary in the container" >&2
+exit 1`
+
+	// dlvNoDebugInfoWarning is logged by dlv once attached to a binary without DWARF information.
+	dlvNoDebugInfoWarning = "no debug info found"
+	// dlvNoDebugInfoError is logged by older dlv versions, which refuse to attach to such a binary.
+	dlvNoDebugInfoError = "could not open debug info"
+
+	noDebugInfoExplanation = `The running %[1]s has no debug information: release builds are linked with
+-ldflags "-s -w", which strips the DWARF information dlv relies on.
+dlv can't list goroutines, show stack traces, evaluate variables or set breakpoints on functions or lines.
+What can still be inspected:
+  - with dlv: the threads, their registers, the memory, the disassembly, and breakpoints set on addresses
+  - its logs:       kubectl logs -n %[2]s %[3]s -c %[4]s
+  - its state:      tridentctl -n %[2]s get backend
+To debug it fully, run trident-debug without --attach-running, which restarts it with a debug build.
+`
+	optimizedBuildNotice = "Trident runs its installed build, which is optimized: variables may be optimized " +
+		"away, functions inlined, and stepping may jump around."
+)
+
+// attachRunningProcess function attaches dlv to the running Trident process of the target, from an ephemeral
+// container added to its pod. Nothing is restarted and the workload is left untouched. On exit dlv detaches and
+// Trident keeps running, the ephemeral container then terminates but stays listed in the pod, as Kubernetes
+// doesn't remove ephemeral containers.
+func attachRunningProcess(ctx context.Context) error {
+	label, containerName := targetWorkload()
+	pod, err := findRunningTargetPod(label, options.NodeName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found the running pod %s on node %s\n", pod.Name, pod.Spec.NodeName)
+
+	if dlvPort, err = resolveDlvPort(&pod.Spec); err != nil {
+		return err
+	}
+
+	ephemeralName := ephemeralContainerPrefix + strconv.FormatInt(time.Now().Unix(), 10)
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, dlvEphemeralContainer(pod, ephemeralName,
+		containerName))
+	if _, err = client.KubeClient.clientset.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(context.TODO(),
+		pod.Name, pod, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("cannot add an ephemeral container to the pod %s: %v", pod.Name, err)
+	}
+	fmt.Printf("Added the ephemeral container %s to the pod %s\n", ephemeralName, pod.Name)
+
+	if pod, err = waitForAttachedDlv(ctx, pod, ephemeralName, containerName); err != nil {
+		return err
+	}
+
+	pfStop, pfErr, localPort, err := startPortForwarding(pod, options.LocalPort)
+	if err != nil {
+		return err
+	}
+	dlvClient, err := dlv.NewClient(net.JoinHostPort(localhost, strconv.Itoa(localPort)))
+	if err != nil {
+		close(pfStop)
+		<-pfErr
+		return err
+	}
+	fmt.Printf("Port-forwarding is ready at localhost:%d -> %d\n", localPort, dlvPort)
+
+	// dlv warns about the missing debug information once attached, which is done by the time it answers.
+	if _, err = dlvClient.State(); err != nil {
+		fmt.Println("Cannot read the state of dlv:", err)
+	}
+	if logs, err := client.KubeClient.GetPodLogs(pod, ephemeralName); err == nil &&
+		strings.Contains(logs, dlvNoDebugInfoWarning) {
+		fmt.Printf(noDebugInfoExplanation, tridentBinaryName(), pod.Namespace, pod.Name, containerName)
+	} else {
+		fmt.Println(optimizedBuildNotice)
+	}
+
+	applier := &breakpointApplier{specs: options.Breakpoints}
+	if len(options.Breakpoints) > 0 {
+		applier.apply(localPort)
+	}
+	printIDEConfigurations(localPort)
+
+	// Signaling that the debugger is attached.
+	deploymentChan := ctx.Value("deploymentChan").(chan int)
+	deploymentChan <- 1
+
+	<-ctx.Done()
+
+	applier.close()
+	fmt.Println("Detaching dlv, trident keeps running...")
+	if err = dlvClient.Detach(false); err != nil {
+		fmt.Println("Cannot detach dlv:", err)
+	}
+	_ = dlvClient.Close()
+	close(pfStop)
+	<-pfErr
+	fmt.Printf("The ephemeral container %s is stopped, it stays listed in the pod %s until the pod is replaced\n",
+		ephemeralName, pod.Name)
+	return err
+}
+
+// findRunningTargetPod function returns a running pod matching the label, on the given node if nodeName isn't
+// empty.
+func findRunningTargetPod(label, nodeName string) (*corev1.Pod, error) {
+	pods, err := client.KubeClient.GetPodsByLabel(label, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if nodeName != "" && pod.Spec.NodeName != nodeName {
+			continue
+		}
+		return pod, nil
+	}
+	if nodeName != "" {
+		return nil, fmt.Errorf("no running %s pod found on node %s", options.Target, nodeName)
+	}
+	return nil, fmt.Errorf("no running %s pod found", options.Target)
+}
+
+// dlvEphemeralContainer function returns the ephemeral container running dlv attached to the Trident process
+// of the target container of the pod. The process is found by findProcessScript, run by the busybox of the image.
+func dlvEphemeralContainer(pod *corev1.Pod, name, targetContainer string) corev1.EphemeralContainer {
+	args := []string{
+		fmt.Sprintf("%s:%d", dlvListenArg, dlvPort),
+		"--headless=true",
+		"--continue",
+		"--api-version=2",
+		"--accept-multiclient",
+		"attach",
+	}
+	if options.WaitForAttach {
+		// dlv halts the running trident when attaching, and leaves it halted until a debugger continues it.
+		args = removeArg(args, "--continue")
+	}
+
+	pullPolicy := corev1.PullAlways
+	if options.LocalImage {
+		pullPolicy = corev1.PullIfNotPresent
+	}
+
+	return corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            name,
+			Image:           options.Image,
+			ImagePullPolicy: pullPolicy,
+			Command: []string{busyboxBinary, "sh", "-c", findProcessScript, "sh", targetBinary(),
+				containerID(pod, targetContainer), dlvBinary},
+			Args: args,
+			SecurityContext: &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_PTRACE"}},
+				RunAsNonRoot: func(b bool) *bool { return &b }(false),
+				RunAsUser:    func(i int64) *int64 { return &i }(0),
+			},
+		},
+		TargetContainerName: targetContainer,
+	}
+}
+
+// containerID function returns the ID the container runtime gave to the named container of the pod, without the
+// runtime prefix, or an empty string if it has none yet.
+func containerID(pod *corev1.Pod, containerName string) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == containerName {
+			if _, id, found := strings.Cut(status.ContainerID, "://"); found {
+				return id
+			}
+			return status.ContainerID
+		}
+	}
+	return ""
+}
+
+// waitForAttachedDlv function waits until dlv in the ephemeral container is listening, for at most rolloutTimeout
+// or until the context is canceled. When dlv exits instead, its logs are shown, and the missing debug information
+// of the binary is explained.
+func waitForAttachedDlv(ctx context.Context, pod *corev1.Pod, ephemeralName,
+	targetContainer string) (*corev1.Pod, error) {
+	fmt.Println("Waiting for dlv to attach...")
+	pods := client.KubeClient.clientset.CoreV1().Pods(pod.Namespace)
+	var attached *corev1.Pod
+	err := pollUntil(ctx, "dlv to attach", func(ctx context.Context) (bool, error) {
+		current, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		var status *corev1.ContainerStatus
+		for i := range current.Status.EphemeralContainerStatuses {
+			if current.Status.EphemeralContainerStatuses[i].Name == ephemeralName {
+				status = &current.Status.EphemeralContainerStatuses[i]
+			}
+		}
+		if status != nil && status.State.Waiting != nil && (strings.Contains(status.State.Waiting.Reason, "Err") ||
+			strings.HasSuffix(status.State.Waiting.Reason, "BackOff")) {
+			return false, fmt.Errorf("the ephemeral container %s can't start: %s %s", ephemeralName,
+				status.State.Waiting.Reason, status.State.Waiting.Message)
+		}
+		if status == nil || (status.State.Running == nil && status.State.Terminated == nil) {
+			return false, nil
+		}
+
+		logs, err := client.KubeClient.GetPodLogs(current, ephemeralName)
+		if err != nil {
+			return false, err
+		}
+		if strings.Contains(logs, dlvListeningMessage) {
+			attached = current
+			return true, nil
+		}
+		if status.State.Terminated != nil {
+			if strings.Contains(logs, dlvNoDebugInfoError) {
+				fmt.Printf(noDebugInfoExplanation, tridentBinaryName(), current.Namespace, current.Name,
+					targetContainer)
+				return false, fmt.Errorf("this dlv can't attach to %s, it has no debug information",
+					tridentBinaryName())
+			}
+			return false, fmt.Errorf("dlv exited without attaching to %s:\n%s", tridentBinaryName(), logs)
+		}
+		return false, nil
+	})
+	return attached, err
+}
+
+// tridentBinaryName function returns the file name of the binary of the target.
+func tridentBinaryName() string {
+	return strings.TrimPrefix(targetBinary(), "/")
+}
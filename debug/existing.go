@@ -0,0 +1,228 @@
+package debug
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	annotationPrefix = "trident-debug.netapp.io/"
+	// SessionIDAnnotation holds the ID of the session debugging the workload, the ID of its record.
+	SessionIDAnnotation = annotationPrefix + "session-id"
+	// SessionUserAnnotation holds the user, as user@host, who started the session.
+	SessionUserAnnotation = annotationPrefix + "user"
+	// SessionStartAnnotation holds the start time of the session, in RFC 3339.
+	SessionStartAnnotation = annotationPrefix + "start-time"
+	// OriginalImageAnnotation holds the image the debugged container ran before the session.
+	OriginalImageAnnotation = annotationPrefix + "original-image"
+
+	// ExistingSessionAsk asks what to do with a workload another session is debugging.
+	ExistingSessionAsk = "ask"
+	// ExistingSessionTakeOver restores the workload of the other session and starts this one in its place.
+	ExistingSessionTakeOver = "take-over"
+	// ExistingSessionRestore restores the workload of the other session, without starting this one.
+	ExistingSessionRestore = "restore"
+	// ExistingSessionAbort leaves the other session alone and stops.
+	ExistingSessionAbort = "abort"
+)
+
+// existingSession describes the session a workload is found debugged by.
+type existingSession struct {
+	kind, name string
+	// id is empty for a workload running dlv without the annotations, modified by an older trident-debug.
+	id            string
+	user          string
+	started       string
+	originalImage string
+	image         string
+}
+
+// sessionAnnotations function returns the annotations marking a workload debugged by the session.
+func sessionAnnotations(state *SessionState, originalImage string) map[string]string {
+	return map[string]string{
+		SessionIDAnnotation:     state.ID,
+		SessionUserAnnotation:   sessionUser(),
+		SessionStartAnnotation:  state.Started.Format(time.RFC3339),
+		OriginalImageAnnotation: originalImage,
+	}
+}
+
+// annotate function adds the annotations to the object metadata.
+func annotate(meta *metav1.ObjectMeta, annotations map[string]string) {
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		meta.Annotations[key] = value
+	}
+}
+
+// removeSessionAnnotations function removes the annotations of the session from the object metadata.
+func removeSessionAnnotations(meta *metav1.ObjectMeta) {
+	for key := range meta.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			delete(meta.Annotations, key)
+		}
+	}
+}
+
+// ownedBySession function reports whether the workload is still debugged by the session, telling otherwise that
+// it is left alone. Another session may have taken the workload over, or restored it, since the session started.
+func ownedBySession(kind string, meta metav1.ObjectMeta, sessionID string) bool {
+	owner := meta.Annotations[SessionIDAnnotation]
+	if owner == sessionID {
+		return true
+	}
+	if owner == "" {
+		fmt.Printf("The %s %s is no longer debugged by the session %s, leaving it alone\n", strings.ToLower(kind),
+			meta.Name, sessionID)
+	} else {
+		fmt.Printf("The %s %s was taken over by the session %s, leaving it to that session\n",
+			strings.ToLower(kind), meta.Name, owner)
+	}
+	return false
+}
+
+// sessionUser function returns the local user as user@host.
+func sessionUser() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// containerImage function returns the image of the named container of the pod spec.
+func containerImage(podSpec *corev1.PodSpec, containerName string) string {
+	for _, container := range podSpec.Containers {
+		if container.Name == containerName {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+// findExistingSession function returns the session debugging the workload, or nil if it isn't debugged. A
+// workload is debugged when it carries the session annotations, or when its container runs dlv.
+func findExistingSession(kind string, meta metav1.ObjectMeta, podSpec *corev1.PodSpec,
+	containerName string) *existingSession {
+	existing := &existingSession{
+		kind:          strings.ToLower(kind),
+		name:          meta.Name,
+		id:            meta.Annotations[SessionIDAnnotation],
+		user:          meta.Annotations[SessionUserAnnotation],
+		started:       meta.Annotations[SessionStartAnnotation],
+		originalImage: meta.Annotations[OriginalImageAnnotation],
+		image:         containerImage(podSpec, containerName),
+	}
+	if existing.id != "" {
+		return existing
+	}
+	for _, container := range podSpec.Containers {
+		if container.Name == containerName && len(container.Command) > 0 && container.Command[0] == dlvBinary {
+			return existing
+		}
+	}
+	return nil
+}
+
+// resolveExistingSession function tells what was found, and takes over, restores or leaves the other session,
+// as chosen by the options or, by default, the user. It returns whether this session goes on. Taking over and
+// restoring revert the workload from the record of the other session, which is only found on the machine that
+// started it.
+func resolveExistingSession(existing *existingSession) (bool, error) {
+	if existing.id == "" {
+		fmt.Printf("The %s %s runs dlv with the image %s, but carries no trident-debug annotations.\n",
+			existing.kind, existing.name, existing.image)
+		fmt.Printf("Revert it with: %s rollout undo %s/%s -n %s\n", CLIKubernetes, existing.kind, existing.name,
+			client.Namespace)
+		return false, fmt.Errorf("the %s %s is already debugged", existing.kind, existing.name)
+	}
+
+	fmt.Printf("The %s %s is already debugged by the session %s, started by %s at %s.\n", existing.kind,
+		existing.name, existing.id, existing.user, existing.started)
+	fmt.Printf("It runs the image %s instead of %s.\n", existing.image, existing.originalImage)
+
+	state, err := findSessionState(existing.id)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		fmt.Printf("The session has no record on this machine, restore it where it was started with: "+
+			"trident-debug restore --session %s\n", existing.id)
+		return false, fmt.Errorf("the %s %s is already debugged", existing.kind, existing.name)
+	}
+
+	choice := options.ExistingSession
+	if choice == "" || choice == ExistingSessionAsk {
+		if choice, err = askExistingSession(); err != nil {
+			return false, err
+		}
+	}
+
+	switch choice {
+	case ExistingSessionTakeOver, ExistingSessionRestore:
+		fmt.Printf("Restoring the session %s...\n", existing.id)
+		if err = RestoreSession(state, KubeConfigPath); err != nil {
+			return false, fmt.Errorf("cannot restore the session %s: %v", existing.id, err)
+		}
+		if choice == ExistingSessionRestore {
+			fmt.Printf("The session %s is restored, no new session is started\n", existing.id)
+			return false, nil
+		}
+		fmt.Println("Starting this session in its place. If the process of the other session is still " +
+			"running, it leaves the workload to this session when it exits.")
+		return true, nil
+	case ExistingSessionAbort:
+		return false, fmt.Errorf("the %s %s is already debugged", existing.kind, existing.name)
+	default:
+		return false, fmt.Errorf("unknown choice %s for the existing session", choice)
+	}
+}
+
+// askExistingSession function asks the user what to do with the existing session.
+func askExistingSession() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("[t]ake it over, [r]estore it, or [a]bort? ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			// Without an answer, the other session is left alone.
+			fmt.Println()
+			return ExistingSessionAbort, nil
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "t", "take over", ExistingSessionTakeOver:
+			return ExistingSessionTakeOver, nil
+		case "r", ExistingSessionRestore:
+			return ExistingSessionRestore, nil
+		case "a", ExistingSessionAbort:
+			return ExistingSessionAbort, nil
+		}
+	}
+}
+
+// findSessionState function returns the record of the session, or nil if it isn't on this machine.
+func findSessionState(id string) (*SessionState, error) {
+	states, err := ListSessionStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.ID == id {
+			return state, nil
+		}
+	}
+	return nil, nil
+}
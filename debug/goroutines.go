@@ -0,0 +1,265 @@
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	// goroutinesPerRequest is the number of goroutines requested from dlv at once.
+	goroutinesPerRequest = 1000
+	// wholeStackReadDepth is the number of frames first read for whole stacks, the deeper ones are read again
+	// with twice as many frames until they are complete.
+	wholeStackReadDepth = 64
+)
+
+// GoroutineReport is a snapshot of the goroutines of the debugged process, grouped by identical stacks. A
+// StackDepth of 0 means whole stacks.
+type GoroutineReport struct {
+	Time       time.Time         `json:"time"`
+	Total      int               `json:"total"`
+	Groups     []*GoroutineGroup `json:"groups"`
+	StackDepth int               `json:"stackDepth"`
+}
+
+// GoroutineGroup is a set of goroutines sharing the same status and stack. Truncated tells that the stack was
+// cut at the depth of the report, the goroutines of the group may then differ below it.
+type GoroutineGroup struct {
+	Count     int                 `json:"count"`
+	Status    string              `json:"status"`
+	IDs       []int64             `json:"ids"`
+	Labels    []map[string]string `json:"labels,omitempty"`
+	Stack     []GoroutineFrame    `json:"stack"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+// GoroutineFrame is a frame of a goroutine stack.
+type GoroutineFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// CollectGoroutineReport function halts the process for as long as it takes to read every goroutine with its
+// stack, up to depth frames or whole for a depth of 0, and resumes it afterwards.
+func CollectGoroutineReport(dlvClient *dlv.Client, depth int) (*GoroutineReport, error) {
+	report := &GoroutineReport{Time: time.Now(), StackDepth: depth}
+	groups := make(map[string]*GoroutineGroup)
+
+	err := dlvClient.WithHalted(func() error {
+		for start := 0; ; {
+			goroutines, next, err := dlvClient.ListGoroutines(start, goroutinesPerRequest)
+			if err != nil {
+				return err
+			}
+			stacks, truncated, err := readStacks(dlvClient, goroutines, depth)
+			if err != nil {
+				return err
+			}
+			for i, g := range goroutines {
+				addToGroup(groups, g, stacks[i], truncated[i])
+				report.Total++
+			}
+			if next <= 0 {
+				return nil
+			}
+			start = next
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		sort.Slice(group.IDs, func(i, j int) bool { return group.IDs[i] < group.IDs[j] })
+		report.Groups = append(report.Groups, group)
+	}
+	// The largest groups come first, as they are the usual suspects of a hang.
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Count != report.Groups[j].Count {
+			return report.Groups[i].Count > report.Groups[j].Count
+		}
+		return report.Groups[i].IDs[0] < report.Groups[j].IDs[0]
+	})
+
+	return report, nil
+}
+
+// readStacks function reads the stacks of the goroutines, cut at depth frames or whole for a depth of 0, and
+// tells which were cut. dlv returns one frame more than the depth it is given when the stack goes on.
+func readStacks(dlvClient *dlv.Client, goroutines []*dlv.Goroutine, depth int) ([][]dlv.Stackframe, []bool,
+	error) {
+	stacks := make([][]dlv.Stackframe, len(goroutines))
+	truncated := make([]bool, len(goroutines))
+	pending := make([]int, len(goroutines))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	readDepth := depth
+	if depth == 0 {
+		readDepth = wholeStackReadDepth
+	}
+	for ; len(pending) > 0; readDepth *= 2 {
+		ids := make([]int64, len(pending))
+		for j, i := range pending {
+			ids[j] = goroutines[i].ID
+		}
+		read, err := dlvClient.Stacktraces(ids, readDepth)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var deeper []int
+		for j, i := range pending {
+			frames := read[j]
+			if len(frames) > readDepth {
+				if depth == 0 {
+					deeper = append(deeper, i)
+					continue
+				}
+				frames, truncated[i] = frames[:depth], true
+			}
+			stacks[i] = frames
+		}
+		pending = deeper
+	}
+	return stacks, truncated, nil
+}
+
+// addToGroup function adds the goroutine to the group of its status and stack, creating it when needed. A cut
+// stack is only grouped with the stacks cut at the same frames.
+func addToGroup(groups map[string]*GoroutineGroup, g *dlv.Goroutine, frames []dlv.Stackframe, truncated bool) {
+	status := goroutineStatus(g)
+	stack := make([]GoroutineFrame, 0, len(frames))
+	var key strings.Builder
+	key.WriteString(status)
+	for i := range frames {
+		frame := GoroutineFrame{Function: "?", File: frames[i].File, Line: frames[i].Line}
+		if frames[i].Function != nil {
+			frame.Function = frames[i].Function.Name
+		}
+		stack = append(stack, frame)
+		fmt.Fprintf(&key, "|%s %s:%d", frame.Function, frame.File, frame.Line)
+	}
+	if truncated {
+		key.WriteString("|...")
+	}
+
+	group, ok := groups[key.String()]
+	if !ok {
+		group = &GoroutineGroup{Status: status, Stack: stack, Truncated: truncated}
+		groups[key.String()] = group
+	}
+	group.Count++
+	group.IDs = append(group.IDs, g.ID)
+	if len(g.Labels) > 0 && !containsLabels(group.Labels, g.Labels) {
+		group.Labels = append(group.Labels, g.Labels)
+	}
+}
+
+// containsLabels function tells whether the label set is already part of the list.
+func containsLabels(list []map[string]string, labels map[string]string) bool {
+	for _, existing := range list {
+		if len(existing) != len(labels) {
+			continue
+		}
+		same := true
+		for k, v := range labels {
+			if existing[k] != v {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// goroutineStatus function returns the readable status of the goroutine.
+func goroutineStatus(g *dlv.Goroutine) string {
+	if g.ThreadID != 0 {
+		return "running"
+	}
+	switch g.Status {
+	case dlv.GoroutineIdle:
+		return "idle"
+	case dlv.GoroutineRunnable:
+		return "runnable"
+	case dlv.GoroutineRunning:
+		return "running"
+	case dlv.GoroutineSyscall:
+		return "syscall"
+	case dlv.GoroutineWaiting:
+		return "waiting"
+	case dlv.GoroutineDead:
+		return "dead"
+	default:
+		return fmt.Sprintf("status %d", g.Status)
+	}
+}
+
+// WriteJSON function writes the report as indented JSON.
+func (r *GoroutineReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText function writes the report in a readable form, one block per group of goroutines.
+func (r *GoroutineReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d goroutines in %d groups, collected at %s\n", r.Total, len(r.Groups),
+		r.Time.Format(time.RFC3339))
+
+	for _, group := range r.Groups {
+		fmt.Fprintf(&b, "\n%d goroutines [%s]: %s\n", group.Count, group.Status, formatGoroutineIDs(group.IDs))
+		for _, labels := range group.Labels {
+			fmt.Fprintf(&b, "  labels: %s\n", formatLabels(labels))
+		}
+		for _, frame := range group.Stack {
+			fmt.Fprintf(&b, "    %s()\n        %s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if group.Truncated {
+			fmt.Fprintf(&b, "    ... cut at %d frames\n", r.StackDepth)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// formatGoroutineIDs function lists the goroutine IDs, shortening long lists.
+func formatGoroutineIDs(ids []int64) string {
+	const maxListed = 10
+	listed := make([]string, 0, maxListed)
+	for i := 0; i < len(ids) && i < maxListed; i++ {
+		listed = append(listed, fmt.Sprint(ids[i]))
+	}
+	if len(ids) > maxListed {
+		listed = append(listed, fmt.Sprintf("and %d more", len(ids)-maxListed))
+	}
+	return strings.Join(listed, ", ")
+}
+
+// formatLabels function formats the labels sorted by key.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,240 @@
+package debug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	// tridentBuildRoot is the path of the Trident sources compiled into the debug binaries trident-debug builds,
+	// with -trimpath.
+	tridentBuildRoot = "github.com/netapp/trident"
+	vscodeDirectory  = ".vscode"
+	vscodeLaunchFile = "launch.json"
+	vscodeVersion    = "0.2.0"
+	localhost        = "127.0.0.1"
+)
+
+// substitutePath is a single path mapping of a VS Code Go launch configuration.
+type substitutePath struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// vscodeLaunchConfiguration is a VS Code Go configuration, either attaching to a remote dlv JSON-RPC server or
+// launching the binary through a remote dlv DAP server.
+type vscodeLaunchConfiguration struct {
+	Name           string           `json:"name"`
+	Type           string           `json:"type"`
+	Request        string           `json:"request"`
+	Mode           string           `json:"mode"`
+	Program        string           `json:"program,omitempty"`
+	Args           []string         `json:"args,omitempty"`
+	Host           string           `json:"host"`
+	Port           int              `json:"port"`
+	SubstitutePath []substitutePath `json:"substitutePath,omitempty"`
+}
+
+// ideConfigurationName returns the name of the generated run configurations for the current target.
+func ideConfigurationName() string {
+	return "trident-debug " + options.Target
+}
+
+// newVSCodeLaunchConfiguration function returns the VS Code configuration connecting to dlv on the local port,
+// mapping the build root of the debug binary, when known, to the local Trident source tree. With the DAP server
+// the configuration launches the debugged command, as the server doesn't start it by itself.
+func newVSCodeLaunchConfiguration(sourcePath, remoteRoot string, localPort int) vscodeLaunchConfiguration {
+	configuration := vscodeLaunchConfiguration{
+		Name:    ideConfigurationName(),
+		Type:    "go",
+		Request: "attach",
+		Mode:    "remote",
+		Host:    localhost,
+		Port:    localPort,
+	}
+	if remoteRoot != "" {
+		configuration.SubstitutePath = []substitutePath{{From: sourcePath, To: remoteRoot}}
+	}
+	if options.DlvServer == DlvServerDAP && len(debuggedCommand) > 0 {
+		configuration.Request = "launch"
+		configuration.Mode = "exec"
+		configuration.Program = debuggedCommand[0]
+		configuration.Args = debuggedCommand[1:]
+	}
+	return configuration
+}
+
+// newJetBrainsRunConfiguration function returns the GoLand "Go Remote" run configuration attaching to dlv on the
+// local port. The debug binary records its sources under its build root rather than the local path, so the build
+// root, when known, is mapped to the local Trident source tree, as in the VS Code configuration.
+func newJetBrainsRunConfiguration(sourcePath, remoteRoot string, localPort int) string {
+	pathMappings := ""
+	if remoteRoot != "" {
+		pathMappings = fmt.Sprintf(`
+    <pathMappings>
+      <mapping local-root="%s" remote-root="%s" />
+    </pathMappings>`, html.EscapeString(sourcePath), html.EscapeString(remoteRoot))
+	}
+	return fmt.Sprintf(`<component name="ProjectRunConfigurationManager">
+  <configuration default="false" name="%s" type="GoRemoteDebugConfigurationType" factoryName="Go Remote">
+    <option name="disconnectOption" value="LEAVE" />
+    <option name="host" value="%s" />
+    <option name="port" value="%d" />%s
+    <method v="2" />
+  </configuration>
+</component>`, ideConfigurationName(), localhost, localPort, pathMappings)
+}
+
+// debuggedSourceRoot function returns the directory the debugged binary was built from, as recorded in its DWARF
+// information, for the IDEs to map it to the local source tree. It is read from the location of main.main through
+// dlv. The DAP server doesn't serve dlv's JSON-RPC, in which case only the -trimpath root of the binaries
+// trident-debug built is known. It returns an empty root, and warns, when the build root is unknown.
+func debuggedSourceRoot(sourcePath string, localPort int) string {
+	if options.DlvServer == DlvServerRPC {
+		root, err := dlvSourceRoot(sourcePath, localPort)
+		if err == nil {
+			return root
+		}
+		fmt.Println("Cannot find the build root of the debugged binary:", err)
+	}
+	if options.SourceBuilt {
+		return tridentBuildRoot
+	}
+	fmt.Printf("Warning: the debugged binary wasn't built by trident-debug, its sources aren't mapped to %s, "+
+		"breakpoints set in the IDE may not bind\n", sourcePath)
+	return ""
+}
+
+// dlvSourceRoot function asks dlv on the local port for the file of main.main, and returns the directory it was
+// built in, which holds the same file in the local source tree. A running process is halted for the lookup.
+func dlvSourceRoot(sourcePath string, localPort int) (string, error) {
+	dlvClient, err := dlv.NewClient(net.JoinHostPort(localhost, strconv.Itoa(localPort)))
+	if err != nil {
+		return "", err
+	}
+	defer dlvClient.Close()
+
+	// dlv only looks locations up in a stopped process.
+	var locations []dlv.Location
+	if err = dlvClient.WithHalted(func() error {
+		locations, err = dlvClient.FindLocation("main.main")
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if len(locations) == 0 {
+		return "", fmt.Errorf("main.main not found")
+	}
+	file := locations[0].File
+	// The longest suffix of the remote path found in the local tree is the path relative to the build root, a
+	// shorter one such as main.go may be another main package.
+	parts := strings.Split(file, "/")
+	for i := 1; i < len(parts); i++ {
+		relative := filepath.FromSlash(strings.Join(parts[i:], "/"))
+		if _, err = os.Stat(filepath.Join(sourcePath, relative)); err == nil {
+			if root := strings.Join(parts[:i], "/"); root != "" {
+				return root, nil
+			}
+			return "/", nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't in %s", file, sourcePath)
+}
+
+// printIDEConfigurations function prints the VS Code and JetBrains run configurations for the session,
+// and writes the VS Code one into the Trident source tree's .vscode directory when asked to.
+func printIDEConfigurations(localPort int) {
+	sourcePath, err := filepath.Abs(options.TridentSourcePath)
+	if err != nil {
+		fmt.Println("Cannot resolve the Trident source path:", err)
+		return
+	}
+
+	remoteRoot := debuggedSourceRoot(sourcePath, localPort)
+	vscodeConfiguration := newVSCodeLaunchConfiguration(sourcePath, remoteRoot, localPort)
+	vscodeJSON, err := json.MarshalIndent(vscodeConfiguration, "", "    ")
+	if err != nil {
+		fmt.Println("Cannot generate the VS Code launch configuration:", err)
+		return
+	}
+
+	fmt.Println("VS Code launch configuration:")
+	fmt.Println(string(vscodeJSON))
+	if options.DlvServer == DlvServerDAP {
+		// GoLand only speaks dlv's JSON-RPC, other editors need the launch request spelled out.
+		fmt.Printf("Other DAP clients: connect to %s:%d and send a launch request with mode exec, "+
+			"program %s and the args above.\n", localhost, localPort, vscodeConfiguration.Program)
+		fmt.Println("dlv exits, restarting the container, once the DAP client disconnects.")
+	} else {
+		fmt.Println("GoLand run configuration:")
+		fmt.Println(newJetBrainsRunConfiguration(sourcePath, remoteRoot, localPort))
+	}
+	if remoteRoot != "" {
+		fmt.Printf("Path mapping: remote %s -> local %s\n", remoteRoot, sourcePath)
+	}
+
+	if !options.WriteVSCodeConfig {
+		return
+	}
+	launchFile, err := writeVSCodeLaunchConfiguration(sourcePath, vscodeConfiguration)
+	if err != nil {
+		fmt.Println("Cannot write the VS Code launch configuration:", err)
+		return
+	}
+	fmt.Printf("VS Code launch configuration written to %s\n", launchFile)
+}
+
+// writeVSCodeLaunchConfiguration function adds the configuration to the launch.json of the source tree, replacing
+// a previous configuration of the same name and keeping every other configuration. It returns the file written.
+func writeVSCodeLaunchConfiguration(sourcePath string, configuration vscodeLaunchConfiguration) (string, error) {
+	launchDirectory := filepath.Join(sourcePath, vscodeDirectory)
+	launchFile := filepath.Join(launchDirectory, vscodeLaunchFile)
+
+	launch := map[string]interface{}{}
+	content, err := os.ReadFile(launchFile)
+	if err == nil {
+		// launch.json may contain comments, which can't be parsed, in which case it is left untouched.
+		if err = json.Unmarshal(content, &launch); err != nil {
+			return "", fmt.Errorf("cannot parse %s, please add the configuration by hand: %v", launchFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if _, ok := launch["version"]; !ok {
+		launch["version"] = vscodeVersion
+	}
+
+	configurations, _ := launch["configurations"].([]interface{})
+	kept := make([]interface{}, 0, len(configurations)+1)
+	for _, existing := range configurations {
+		if existingMap, ok := existing.(map[string]interface{}); ok && existingMap["name"] == configuration.Name {
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	launch["configurations"] = append(kept, configuration)
+
+	launchJSON, err := json.MarshalIndent(launch, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(launchDirectory, 0755); err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(launchFile, append(launchJSON, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	return launchFile, nil
+}
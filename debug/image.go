@@ -0,0 +1,131 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeArchLabel is the well-known node label holding the architecture of the node.
+const NodeArchLabel = "kubernetes.io/arch"
+
+// InstalledImage function returns the image the debugged container of the target runs in the cluster, as set in
+// the spec of its deployment or daemonset. A workload a session debugs runs a debug image, the original image
+// recorded by the session is returned instead.
+func InstalledImage(kubeConfigPath, target string) (string, error) {
+	clients, err := createK8sClient("", kubeConfigPath, tridentNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	var meta metav1.ObjectMeta
+	var podSpec *corev1.PodSpec
+	var kind, workload, containerName string
+	switch target {
+	case TargetNode:
+		kind, workload, containerName = kindDaemonSet, tridentNodeDaemonSetName, tridentNodeMainContainer
+		daemonSet, err := clients.KubeClient.GetDaemonSet().Get(context.TODO(), workload, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		meta, podSpec = daemonSet.ObjectMeta, &daemonSet.Spec.Template.Spec
+	case TargetOperator:
+		kind, workload, containerName = kindDeployment, tridentOperatorDeploymentName, tridentOperatorContainer
+		deployment, err := clients.KubeClient.GetDeployment().Get(context.TODO(), workload, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		meta, podSpec = deployment.ObjectMeta, &deployment.Spec.Template.Spec
+	default:
+		kind, workload, containerName = kindDeployment, tridentControllerDeploymentName,
+			tridentDeploymentMainContainer
+		deployment, err := clients.KubeClient.GetDeployment().Get(context.TODO(), workload, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		meta, podSpec = deployment.ObjectMeta, &deployment.Spec.Template.Spec
+	}
+
+	// Layering onto the image of a debugged workload would stack the debug layers of both sessions.
+	if existing := findExistingSession(kind, meta, podSpec, containerName); existing != nil {
+		if existing.originalImage == "" {
+			return "", fmt.Errorf("the %s %s runs dlv with the image %s, but doesn't record its original image, "+
+				"please revert it first", existing.kind, workload, existing.image)
+		}
+		fmt.Printf("The %s %s is debugged by the session %s, using its original image %s\n", existing.kind,
+			workload, existing.id, existing.originalImage)
+		return existing.originalImage, nil
+	}
+
+	for _, container := range podSpec.Containers {
+		if container.Name == containerName {
+			return container.Image, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find the container %s in %s", containerName, workload)
+}
+
+// NodeArch function returns the architecture of the nodes the target runs on: the selected node for the node
+// plugin, otherwise the node running the pod of the target. Without such a pod, the nodes of the cluster must all
+// be of the same architecture.
+func NodeArch(kubeConfigPath, target, nodeName string) (string, error) {
+	clients, err := createK8sClient("", kubeConfigPath, tridentNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	if target != TargetNode {
+		label := TridentCSILabel
+		if target == TargetOperator {
+			label = TridentOperatorLabel
+		}
+		pods, err := clients.KubeClient.GetPodsByLabel(label, false)
+		if err != nil {
+			return "", err
+		}
+		for _, pod := range pods {
+			if pod.Spec.NodeName != "" {
+				nodeName = pod.Spec.NodeName
+				break
+			}
+		}
+	}
+
+	if nodeName != "" {
+		node, err := clients.KubeClient.GetNode(nodeName)
+		if err != nil {
+			return "", fmt.Errorf("cannot find node %s: %v", nodeName, err)
+		}
+		if arch := node.Labels[NodeArchLabel]; arch != "" {
+			return arch, nil
+		}
+		return "", fmt.Errorf("node %s has no %s label", nodeName, NodeArchLabel)
+	}
+
+	nodes, err := clients.KubeClient.clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	archs := make(map[string]bool)
+	for _, node := range nodes.Items {
+		archs[node.Labels[NodeArchLabel]] = true
+	}
+	if len(archs) == 1 {
+		for arch := range archs {
+			if arch != "" {
+				return arch, nil
+			}
+		}
+	}
+	found := make([]string, 0, len(archs))
+	for arch := range archs {
+		found = append(found, arch)
+	}
+	sort.Strings(found)
+	return "", fmt.Errorf("cannot tell the architecture of the nodes %s will run on, the nodes are %s", target,
+		strings.Join(found, ", "))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"time"
@@ -14,30 +15,95 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	typesv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
 const (
-	k8sTimeout           = 30 * time.Second
-	defaultNamespace     = "default"
-	tridentNamespace     = "trident"
-	QPS                  = 50
-	burstTime            = 100
-	TridentCSILabelKey   = "app"
-	TridentCSILabelValue = "controller.csi.trident.netapp.io"
-	TridentCSILabel      = TridentCSILabelKey + "=" + TridentCSILabelValue
+	k8sTimeout                = 30 * time.Second
+	defaultNamespace          = "default"
+	tridentNamespace          = "trident"
+	QPS                       = 50
+	burstTime                 = 100
+	TridentCSILabelKey        = "app"
+	TridentCSILabelValue      = "controller.csi.trident.netapp.io"
+	TridentCSILabel           = TridentCSILabelKey + "=" + TridentCSILabelValue
+	TridentNodeLabelValue     = "node.csi.trident.netapp.io"
+	TridentNodeLabel          = TridentCSILabelKey + "=" + TridentNodeLabelValue
+	TridentOperatorLabelValue = "operator.trident.netapp.io"
+	TridentOperatorLabel      = TridentCSILabelKey + "=" + TridentOperatorLabelValue
+)
+
+const (
+	// TargetController debugs the trident-main container of the trident-controller deployment.
+	TargetController = "controller"
+	// TargetNode debugs the trident-main container of the node plugin on a single node.
+	TargetNode = "node"
+	// TargetOperator debugs the trident-operator deployment.
+	TargetOperator = "operator"
+
+	// DlvServerRPC runs dlv as a headless JSON-RPC server.
+	DlvServerRPC = "rpc"
+	// DlvServerDAP runs dlv as a Debug Adapter Protocol server.
+	DlvServerDAP = "dap"
+
+	// DefaultRemotePort is the port dlv listens on in the debug pod, unless configured otherwise.
+	DefaultRemotePort = 40000
+	// DefaultLocalPort is the local port forwarded to dlv, unless configured otherwise.
+	DefaultLocalPort = 40000
+	// DefaultTridentSourcePath is the Trident checkout, trident-debug is expected to live in a directory of it.
+	DefaultTridentSourcePath = ".."
 )
 
 var (
-	KubeConfigPath       string
-	CLIKubernetes        = "kubectl"
-	client               *Clients
-	artifactoryNamespace string
-	artifactoryFolder    string
+	KubeConfigPath string
+	CLIKubernetes  = "kubectl"
+	client         *Clients
+	options        Options
 )
 
+// Options holds everything the user can configure for a debug session.
+type Options struct {
+	KubeConfigPath string
+	// Image is the reference of the debug image the debugged container runs.
+	Image string
+	// Arch is the architecture of the image, the debug pod is kept on nodes of that architecture.
+	Arch string
+	// AttachRunning attaches dlv to the running Trident from an ephemeral container, instead of restarting it
+	// with the debug image. The image then only holds dlv.
+	AttachRunning bool
+	// LocalImage tells that the image was loaded into the cluster nodes, so it is never pulled.
+	LocalImage bool
+	// Target is the Trident workload to debug, one of TargetController, TargetNode or TargetOperator.
+	Target string
+	// NodeName is the node whose node plugin pod is debugged, required for TargetNode.
+	NodeName string
+	// RemotePort is the port dlv listens on in the debug pod.
+	RemotePort int
+	// RemotePortSet tells whether RemotePort was chosen by the user, in which case it is never changed.
+	RemotePortSet bool
+	// LocalPort is the local port forwarded to dlv, 0 picks a free port.
+	LocalPort int
+	// TridentSourcePath is the local Trident checkout the debug binaries are built from.
+	TridentSourcePath string
+	// SourceBuilt tells that trident-debug built the debugged binary from TridentSourcePath, with -trimpath.
+	SourceBuilt bool
+	// WriteVSCodeConfig writes the generated launch configuration into the source tree's .vscode directory.
+	WriteVSCodeConfig bool
+	// WaitForAttach starts trident halted under dlv, so that its startup can be debugged.
+	WaitForAttach bool
+	// DlvServer is the protocol of the in-pod debugger, one of DlvServerRPC or DlvServerDAP.
+	DlvServer string
+	// Breakpoints are set through dlv as soon as the session is ready.
+	Breakpoints []BreakpointSpec
+	// ExistingSession is what to do with a workload another session debugs, one of ExistingSessionAsk,
+	// ExistingSessionTakeOver, ExistingSessionRestore or ExistingSessionAbort.
+	ExistingSession string
+}
+
 type Clients struct {
 	RestConfig *rest.Config
 	KubeClient *KubeClient
@@ -129,6 +195,26 @@ func createK8sClient(
 	}, nil
 }
 
+// CurrentContext returns the name of the current context of the kubeconfig, or of kubectl's configuration if the
+// path is empty
+func CurrentContext(kubeConfigPath string) (string, error) {
+	if kubeConfigPath == "" {
+		out, err := exec.Command(CLIKubernetes, "config", "current-context").CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%s; %v", strings.TrimSpace(string(out)), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeConfigPath
+	apiConfig, err := rules.Load()
+	if err != nil {
+		return "", err
+	}
+	return apiConfig.CurrentContext, nil
+}
+
 func NewKubeClient(config *rest.Config, namespace string, k8sTimeout time.Duration) (*KubeClient, error) {
 	var versionInfo *version.Info
 	if namespace == "" {
@@ -189,32 +275,57 @@ func initClient() (err error) {
 	return nil
 }
 
-func InitDebug(ctx context.Context, kubeConfigPath string, artifactoryNS string, artifactoryF string) (err error) {
-	if kubeConfigPath != "" {
-		KubeConfigPath = kubeConfigPath
+// initSession function applies the defaults to the options, makes them the session's options and connects to
+// the cluster.
+func initSession(opts Options) error {
+	if opts.KubeConfigPath != "" {
+		KubeConfigPath = opts.KubeConfigPath
 	}
 
-	if artifactoryNS != "" {
-		artifactoryNamespace = artifactoryNS
+	if opts.Target == "" {
+		opts.Target = TargetController
 	}
-
-	if artifactoryF != "" {
-		artifactoryFolder = artifactoryF
+	if opts.RemotePort == 0 {
+		opts.RemotePort = DefaultRemotePort
+	}
+	if opts.DlvServer == "" {
+		opts.DlvServer = DlvServerRPC
 	}
+	if opts.TridentSourcePath == "" {
+		opts.TridentSourcePath = DefaultTridentSourcePath
+	}
+	options = opts
 
-	if err = discoverKubernetesCLI(); err != nil {
+	if err := discoverKubernetesCLI(); err != nil {
 		return err
 	}
 
-	if err = initClient(); err != nil {
+	return initClient()
+}
+
+func InitDebug(ctx context.Context, opts Options) (err error) {
+	if err = initSession(opts); err != nil {
 		return err
 	}
 
-	if err = getTridentDeployment(ctx); err != nil {
-		return err
+	if options.AttachRunning {
+		return attachRunningProcess(ctx)
 	}
 
-	return nil
+	switch options.Target {
+	case TargetController:
+		err = getTridentDeployment(ctx, tridentControllerDeploymentName, tridentDeploymentMainContainer,
+			TridentCSILabel)
+	case TargetOperator:
+		err = getTridentDeployment(ctx, tridentOperatorDeploymentName, tridentOperatorContainer,
+			TridentOperatorLabel)
+	case TargetNode:
+		err = debugTridentNode(ctx, options.NodeName)
+	default:
+		err = fmt.Errorf("unknown debug target %s", options.Target)
+	}
+
+	return err
 }
 
 func (k *KubeClient) GetDeployment() typesv1.DeploymentInterface {
@@ -222,6 +333,65 @@ func (k *KubeClient) GetDeployment() typesv1.DeploymentInterface {
 	return deploymentSet
 }
 
+func (k *KubeClient) GetDaemonSet() typesv1.DaemonSetInterface {
+	daemonSet := k.clientset.AppsV1().DaemonSets(k.namespace)
+	return daemonSet
+}
+
+// GetNode returns the node object with the specified name
+func (k *KubeClient) GetNode(nodeName string) (*corev1.Node, error) {
+	return k.clientset.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+}
+
+// GetPodLogs returns the logs of the named container of the pod
+func (k *KubeClient) GetPodLogs(pod *corev1.Pod, containerName string) (string, error) {
+	logs, err := k.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: containerName,
+	}).DoRaw(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return string(logs), nil
+}
+
+// ExecInPod runs the command in the named container of the pod, streaming stdin to its standard input and its
+// standard output to stdout
+func (k *KubeClient) ExecInPod(pod *corev1.Pod, containerName string, command []string, stdin io.Reader,
+	stdout io.Writer,
+) error {
+	request := k.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(k.restConfig, "POST", request.URL())
+	if err != nil {
+		return err
+	}
+
+	var stderr strings.Builder
+	err = executor.StreamWithContext(context.Background(), remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
+
 // GetPodByLabel returns a pod object matching the specified label
 func (k *KubeClient) GetPodByLabel(label string, allNamespaces bool) (*corev1.Pod, error) {
 	pods, err := k.GetPodsByLabel(label, allNamespaces)
@@ -0,0 +1,272 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	tridentNodeDaemonSetName      = "trident-node-linux"
+	tridentNodeDebugDaemonSetName = "trident-node-linux-debug"
+	tridentNodeMainContainer      = "trident-main"
+	debugLabelKey                 = "trident-debug"
+	debugLabelValue               = "true"
+	nodeNameField                 = "metadata.name"
+)
+
+// debugTridentNode function is used to run the trident node plugin under dlv on a single node.
+// The node is split out of the trident node daemonset by excluding it from the daemonset's node affinity,
+// and a debug copy of the daemonset, restricted to that node only, is created in its place.
+// Every other node keeps running the original node plugin. On exit the debug daemonset is deleted and
+// the original daemonset is restored.
+func debugTridentNode(ctx context.Context, nodeName string) (err error) {
+
+	if nodeName == "" {
+		return fmt.Errorf("a node name is required to debug the trident node plugin")
+	}
+	if _, err = client.KubeClient.GetNode(nodeName); err != nil {
+		return fmt.Errorf("cannot find node %s: %v", nodeName, err)
+	}
+
+	daemonSets := client.KubeClient.GetDaemonSet()
+	tridentDaemonSet, err := daemonSets.Get(context.TODO(), tridentNodeDaemonSetName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found daemonset %s in namespace %s\n", tridentDaemonSet.Name, tridentDaemonSet.Namespace)
+
+	// Modifying a debugged daemonset again would stack the debugger onto the other session's.
+	existing := findExistingSession(kindDaemonSet, tridentDaemonSet.ObjectMeta,
+		&tridentDaemonSet.Spec.Template.Spec, tridentNodeMainContainer)
+	debugDaemonSet, err := daemonSets.Get(context.TODO(), tridentNodeDebugDaemonSetName, metav1.GetOptions{})
+	if err == nil {
+		existing = findExistingSession(kindDaemonSet, debugDaemonSet.ObjectMeta, &debugDaemonSet.Spec.Template.Spec,
+			tridentNodeMainContainer)
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	if existing != nil {
+		proceed, err := resolveExistingSession(existing)
+		if err != nil || !proceed {
+			return err
+		}
+		if err = waitForDebugDaemonSetDeletion(ctx, client); err != nil {
+			return err
+		}
+		if tridentDaemonSet, err = daemonSets.Get(context.TODO(), tridentNodeDaemonSetName,
+			metav1.GetOptions{}); err != nil {
+			return err
+		}
+	}
+
+	// The debug daemonset, which only runs on the chosen node.
+	debugDaemonSet, err = newDebugDaemonSet(tridentDaemonSet, nodeName)
+	if err != nil {
+		return err
+	}
+
+	// The session is recorded before the daemonset is modified, so that it can be restored by another process.
+	state, err := newSessionState(kindDaemonSet, tridentNodeDaemonSetName, tridentDaemonSet)
+	if err != nil {
+		return err
+	}
+	state.Mutations = append([]string{
+		fmt.Sprintf("daemonset %s: node %s is excluded", tridentNodeDaemonSetName, nodeName),
+		fmt.Sprintf("daemonset %s is created, restricted to node %s", tridentNodeDebugDaemonSetName, nodeName),
+	}, debuggerMutations(kindDaemonSet, tridentNodeDebugDaemonSetName, tridentNodeMainContainer)...)
+	annotations := sessionAnnotations(state, containerImage(&tridentDaemonSet.Spec.Template.Spec,
+		tridentNodeMainContainer))
+	annotate(&debugDaemonSet.ObjectMeta, annotations)
+	annotate(&debugDaemonSet.Spec.Template.ObjectMeta, annotations)
+	if err = state.save(); err != nil {
+		return fmt.Errorf("cannot record the session: %v", err)
+	}
+
+	// Excluding the node from the original daemonset, so that the node plugin pod on it goes away.
+	excludedDaemonSet := tridentDaemonSet.DeepCopy()
+	restrictToNode(&excludedDaemonSet.Spec.Template.Spec, corev1.NodeSelectorOpNotIn, nodeName)
+	annotate(&excludedDaemonSet.ObjectMeta, annotations)
+	if _, err = daemonSets.Update(context.TODO(), excludedDaemonSet, metav1.UpdateOptions{}); err != nil {
+		state.remove()
+		return err
+	}
+
+	// From here on the daemonset is modified, so it has to be restored whatever happens.
+	defer func() {
+		// The session context may be canceled by now, the revert waits are bounded by rolloutTimeout instead.
+		revertErr := revertTridentNode(context.Background(), client, tridentDaemonSet, state.ID)
+		if revertErr != nil {
+			state.keep()
+			if err == nil {
+				err = revertErr
+			}
+			return
+		}
+		state.remove()
+	}()
+
+	fmt.Printf("Waiting for the trident node pod on %s to terminate...\n", nodeName)
+	if err = waitForNoPodOnNode(ctx, TridentNodeLabel, nodeName); err != nil {
+		return err
+	}
+
+	// Creating the debug daemonset.
+	if _, err = daemonSets.Create(context.TODO(), debugDaemonSet, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Checking if the debug node pod on %s is up...\n", nodeName)
+	if _, err = waitForDebugPod(ctx, TridentNodeLabel, nodeName, tridentNodeMainContainer); err != nil {
+		return err
+	}
+	fmt.Println("Debug daemonset created successfully.")
+
+	return runDebugSession(ctx, TridentNodeLabel, nodeName, tridentNodeMainContainer)
+}
+
+// newDebugDaemonSet function returns a copy of the trident node daemonset, running the node plugin under dlv
+// on the given node only. The copy carries an extra label, so that its pods are told apart from the ones of
+// the original daemonset.
+func newDebugDaemonSet(tridentDaemonSet *appsv1.DaemonSet, nodeName string) (*appsv1.DaemonSet, error) {
+	debugDaemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        tridentNodeDebugDaemonSetName,
+			Namespace:   tridentDaemonSet.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+		},
+		Spec: *tridentDaemonSet.Spec.DeepCopy(),
+	}
+	for key, value := range tridentDaemonSet.Labels {
+		debugDaemonSet.Labels[key] = value
+	}
+	debugDaemonSet.Labels[debugLabelKey] = debugLabelValue
+
+	selector := debugDaemonSet.Spec.Selector
+	if selector == nil {
+		selector = &metav1.LabelSelector{}
+		debugDaemonSet.Spec.Selector = selector
+	}
+	if selector.MatchLabels == nil {
+		selector.MatchLabels = map[string]string{}
+	}
+	selector.MatchLabels[debugLabelKey] = debugLabelValue
+
+	if debugDaemonSet.Spec.Template.Labels == nil {
+		debugDaemonSet.Spec.Template.Labels = map[string]string{}
+	}
+	debugDaemonSet.Spec.Template.Labels[debugLabelKey] = debugLabelValue
+
+	podSpec := &debugDaemonSet.Spec.Template.Spec
+	restrictToNode(podSpec, corev1.NodeSelectorOpIn, nodeName)
+	if err := addDebuggerToContainer(podSpec, tridentNodeMainContainer); err != nil {
+		return nil, err
+	}
+
+	return debugDaemonSet, nil
+}
+
+// restrictToNode function adds a required node affinity on the node name to the pod spec.
+// The requirement is added to every existing node selector term, as the terms are ORed together.
+func restrictToNode(podSpec *corev1.PodSpec, operator corev1.NodeSelectorOperator, nodeName string) {
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      nodeNameField,
+		Operator: operator,
+		Values:   []string{nodeName},
+	}
+
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	nodeSelector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(nodeSelector.NodeSelectorTerms) == 0 {
+		nodeSelector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range nodeSelector.NodeSelectorTerms {
+		term := &nodeSelector.NodeSelectorTerms[i]
+		term.MatchFields = append(term.MatchFields, requirement)
+	}
+}
+
+// waitForNoPodOnNode function waits until no pod matching the label is left on the given node.
+func waitForNoPodOnNode(ctx context.Context, label, nodeName string) error {
+	return pollUntil(ctx, "the trident node pod on "+nodeName+" to terminate", func(context.Context) (bool, error) {
+		pods, err := client.KubeClient.GetPodsByLabel(label, false)
+		if err != nil {
+			return false, err
+		}
+		for _, pod := range pods {
+			if pod.Spec.NodeName == nodeName {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// waitForDebugDaemonSetDeletion function waits until the debug daemonset is deleted, along with its pods.
+func waitForDebugDaemonSetDeletion(ctx context.Context, clients *Clients) error {
+	daemonSets := clients.KubeClient.GetDaemonSet()
+	return pollUntil(ctx, "the deletion of the daemonset "+tridentNodeDebugDaemonSetName,
+		func(ctx context.Context) (bool, error) {
+			_, err := daemonSets.Get(ctx, tridentNodeDebugDaemonSetName, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		})
+}
+
+// revertTridentNode function deletes the debug daemonset and restores the original trident node daemonset, unless
+// another session took the daemonsets over from the session. The original daemonset is only restored once the
+// debug pod is gone, as both pods would otherwise share the host network and the CSI socket of the node.
+func revertTridentNode(ctx context.Context, clients *Clients, tridentDaemonSet *appsv1.DaemonSet,
+	sessionID string) error {
+	fmt.Println("Reverting the changes made to the daemonset...")
+	daemonSets := clients.KubeClient.GetDaemonSet()
+
+	// The original daemonset carries the annotations of the session owning both daemonsets.
+	latestDaemonSet, err := daemonSets.Get(context.TODO(), tridentNodeDaemonSetName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !ownedBySession(kindDaemonSet, latestDaemonSet.ObjectMeta, sessionID) {
+		return nil
+	}
+
+	// Deleting the debug daemonset first, so that the node is free when the original pod comes back.
+	propagation := metav1.DeletePropagationForeground
+	err = daemonSets.Delete(context.TODO(), tridentNodeDebugDaemonSetName, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil {
+		fmt.Println("An error occurred during deleting the debug daemonset:", err)
+	} else if err = waitForDebugDaemonSetDeletion(ctx, clients); err != nil {
+		return err
+	}
+
+	// Get the latest version of the daemonset, changed by the deletion of the debug one.
+	latestDaemonSet, err = daemonSets.Get(context.TODO(), tridentNodeDaemonSetName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	// Reverting the changes made to the daemonset.
+	latestDaemonSet.Spec = tridentDaemonSet.Spec
+	removeSessionAnnotations(&latestDaemonSet.ObjectMeta)
+	// Updating the daemonset with the original spec.
+	_, err = daemonSets.Update(context.TODO(), latestDaemonSet, metav1.UpdateOptions{})
+
+	return err
+}
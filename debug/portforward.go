@@ -0,0 +1,258 @@
+package debug
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	// podCheckInterval is how often the supervisor checks whether the debugged pod has been replaced.
+	podCheckInterval = 2 * time.Second
+	// portForwardReadyTimeout is how long to wait for a port-forward to start listening.
+	portForwardReadyTimeout = 30 * time.Second
+)
+
+// portForwarder keeps a port-forward to the dlv port of the debugged pod alive.
+// When the pod is restarted or replaced, the forward is transparently re-established to the new pod.
+type portForwarder struct {
+	label         string
+	nodeName      string
+	containerName string
+	// localPort is the local port the forward listens on, kept the same when the forward is re-established.
+	localPort int
+	// onReady, if set, is called every time the forward is established to a new dlv: at the start, and whenever
+	// the pod was replaced or its debugged container restarted. A forward merely re-established to the same dlv
+	// doesn't call it, that dlv still has everything set up.
+	onReady func(localPort int)
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// startSupervisedPortForwarding function starts a port-forward to the debug pod matching the label, node and
+// container, and waits until it is ready. The forward is then supervised until stop is called. The onReady
+// function, if not nil, is called every time the forward reaches a new dlv, starting with this one.
+func startSupervisedPortForwarding(label, nodeName, containerName string,
+	onReady func(localPort int),
+) (*portForwarder, error) {
+	f := &portForwarder{
+		label:         label,
+		nodeName:      nodeName,
+		containerName: containerName,
+		localPort:     options.LocalPort,
+		onReady:       onReady,
+		stopChan:      make(chan struct{}),
+		doneChan:      make(chan struct{}),
+	}
+
+	pod, err := findRunningDebugPod(label, nodeName, containerName)
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("no running debug pod found for label %s", label)
+	}
+
+	pfStop, pfErr, localPort, err := startPortForwarding(pod, f.localPort)
+	if err != nil {
+		return nil, err
+	}
+	f.localPort = localPort
+	if f.onReady != nil {
+		f.onReady(f.localPort)
+	}
+
+	go f.supervise(pod, pfStop, pfErr)
+
+	return f, nil
+}
+
+// stop function stops the supervision and the current port-forward, and waits for both to finish.
+func (f *portForwarder) stop() {
+	close(f.stopChan)
+	<-f.doneChan
+}
+
+// supervise function watches the current port-forward and the pod it points to, and re-establishes the forward
+// whenever it is lost or the pod is replaced.
+func (f *portForwarder) supervise(pod *corev1.Pod, pfStop chan struct{}, pfErr chan error) {
+	defer close(f.doneChan)
+
+	ticker := time.NewTicker(podCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stopChan:
+			if pfStop != nil {
+				close(pfStop)
+				<-pfErr
+			}
+			return
+
+		case err := <-pfErr:
+			if err != nil {
+				fmt.Printf("Port-forwarding to the pod %s was lost: %v\n", pod.Name, err)
+			}
+			pfStop, pfErr = nil, nil
+
+		case <-ticker.C:
+			if pfStop != nil {
+				replaced, err := podReplaced(pod, f.label, f.containerName)
+				if err != nil || !replaced {
+					continue
+				}
+				fmt.Printf("The pod %s has been replaced, stopping its port-forwarding...\n", pod.Name)
+				close(pfStop)
+				<-pfErr
+				pfStop, pfErr = nil, nil
+			}
+
+			newPod, err := findRunningDebugPod(f.label, f.nodeName, f.containerName)
+			if err != nil || newPod == nil {
+				continue
+			}
+			newStop, newErr, _, err := startPortForwarding(newPod, f.localPort)
+			if err != nil {
+				fmt.Printf("An error occurred during port-forwarding to the pod %s: %v\n", newPod.Name, err)
+				continue
+			}
+			fmt.Printf("Port-forwarding re-established to the pod %s\n", newPod.Name)
+			newDlv := newPod.Name != pod.Name ||
+				restartCount(newPod, f.containerName) != restartCount(pod, f.containerName)
+			pod, pfStop, pfErr = newPod, newStop, newErr
+			if newDlv && f.onReady != nil {
+				f.onReady(f.localPort)
+			}
+		}
+	}
+}
+
+// podReplaced function reports whether the pod is gone, terminating or its debugged container restarted since
+// the forward was started.
+func podReplaced(pod *corev1.Pod, label, containerName string) (bool, error) {
+	pods, err := client.KubeClient.GetPodsByLabel(label, false)
+	if err != nil {
+		return false, err
+	}
+	for _, current := range pods {
+		if current.Name != pod.Name {
+			continue
+		}
+		if current.DeletionTimestamp != nil {
+			return true, nil
+		}
+		return restartCount(&current, containerName) != restartCount(pod, containerName), nil
+	}
+	return true, nil
+}
+
+// restartCount function returns the number of restarts of the named container of the pod.
+func restartCount(pod *corev1.Pod, containerName string) int32 {
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == containerName {
+			return containerStatus.RestartCount
+		}
+	}
+	return 0
+}
+
+// startPortForwarding function is used to start port forwarding from the local port to the dlv port of the pod.
+// A local port of 0 picks a free port. It waits until the forward is listening and returns the channel stopping
+// it, the channel receiving the result of the forward once it ends and the local port in use.
+func startPortForwarding(pod *corev1.Pod, localPort int) (chan struct{}, chan error, int, error) {
+
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil, nil, 0, fmt.Errorf("pod not running: %s", pod.Name)
+	}
+
+	// URL to the pod's portforward endpoint
+	// e.g., http://localhost:8080/api/v1/namespaces/default/pods/pod-name/portforward
+
+	url := client.KubeClient.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward").URL()
+
+	transport, upgrader, err := spdy.RoundTripperFor(client.RestConfig)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	ports := []string{fmt.Sprintf("%d:%d", localPort, dlvPort)}
+
+	readyChan := make(chan struct{})
+	stopChan := make(chan struct{})
+	errChan := make(chan error, 1)
+
+	// The output of the port-forward goes to our own output, prefixed so that it can be told apart.
+	pf, err := portforward.New(dialer, ports, readyChan, stopChan, newLogWriter("port-forward: "),
+		newLogWriter("port-forward error: "))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// Start port forwarding in a separate goroutine
+	go func() {
+		errChan <- pf.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+		forwardedPorts, err := pf.GetPorts()
+		if err != nil || len(forwardedPorts) == 0 {
+			close(stopChan)
+			<-errChan
+			return nil, nil, 0, fmt.Errorf("cannot determine the local port forwarded to the pod %s: %v",
+				pod.Name, err)
+		}
+		return stopChan, errChan, int(forwardedPorts[0].Local), nil
+	case err = <-errChan:
+		if err == nil {
+			err = fmt.Errorf("port-forwarding to the pod %s ended before it was ready", pod.Name)
+		}
+		return nil, nil, 0, err
+	case <-time.After(portForwardReadyTimeout):
+		close(stopChan)
+		<-errChan
+		return nil, nil, 0, fmt.Errorf("timed out waiting for port-forwarding to the pod %s", pod.Name)
+	}
+}
+
+// logWriter is an io.Writer printing every complete line written to it with a prefix.
+type logWriter struct {
+	prefix string
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func newLogWriter(prefix string) *logWriter {
+	return &logWriter{prefix: prefix}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer.Write(p)
+	for {
+		line, err := w.buffer.ReadString('\n')
+		if err != nil {
+			// Keeping the incomplete line until the rest of it is written.
+			w.buffer.WriteString(line)
+			break
+		}
+		fmt.Print(w.prefix + line)
+	}
+	return len(p), nil
+}
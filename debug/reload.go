@@ -0,0 +1,173 @@
+package debug
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+// ReloadResult describes the breakpoints of a reloaded binary.
+type ReloadResult struct {
+	// Kept is the number of breakpoints dlv set again in the new binary.
+	Kept int
+	// Discarded is the number of breakpoints whose location is gone from the new binary.
+	Discarded int
+}
+
+// session holds the parts of the running debug session a reload has to reach.
+var session struct {
+	sync.Mutex
+	applier   *breakpointApplier
+	localPort int
+}
+
+// ReloadBinary function replaces the debugged binary in the target's debug pod with the local binary, and restarts
+// it under dlv in place: the pod, its port-forwards and the breakpoints are kept, dlv sets the breakpoints again in
+// the new binary. A running process is resumed after the restart, a halted one stays halted at its entry point.
+func ReloadBinary(opts Options, binaryPath string) error {
+	if err := initSession(opts); err != nil {
+		return err
+	}
+
+	pod, dlvClient, closeClient, err := connectDebugPod()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	_, containerName := targetWorkload()
+	if err = copyBinaryToPod(pod, containerName, binaryPath); err != nil {
+		return err
+	}
+
+	running, _, err := restartDebugged(dlvClient)
+	if err != nil {
+		return err
+	}
+	if running {
+		dlvClient.ContinueAsync()
+		fmt.Println("Reloaded, the new binary is running")
+	} else {
+		fmt.Println("Reloaded, the new binary is halted at its entry point, continue it from your debugger")
+	}
+	return nil
+}
+
+// ReloadSession function reloads the local binary in the debug pod of the debug session running in this process,
+// the way ReloadBinary does, through the port-forward of the session. The tracepoints of the session are resumed
+// again after the restart.
+func ReloadSession(binaryPath string) (*ReloadResult, error) {
+	session.Lock()
+	defer session.Unlock()
+	if session.applier == nil {
+		return nil, fmt.Errorf("no debug session is running")
+	}
+
+	label, containerName := targetWorkload()
+	pod, err := findRunningDebugPod(label, options.NodeName, containerName)
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("no running %s debug pod found", options.Target)
+	}
+	if err = copyBinaryToPod(pod, containerName, binaryPath); err != nil {
+		return nil, err
+	}
+	return session.applier.reload(session.localPort)
+}
+
+// copyBinaryToPod function replaces the binary dlv debugs in the container of the debug pod with the local one.
+func copyBinaryToPod(pod *corev1.Pod, containerName, binaryPath string) error {
+	if podRunsDAPServer(pod, containerName) {
+		return fmt.Errorf("reloading needs the %s dlv server, the pod %s runs the %s one", DlvServerRPC, pod.Name,
+			DlvServerDAP)
+	}
+
+	binary, err := os.Open(binaryPath)
+	if err != nil {
+		return err
+	}
+	defer binary.Close()
+
+	// The running binary can't be written, so the new one is written next to it and renamed over it.
+	podBinary := podDebuggedBinary(pod, containerName)
+	podUpload := podBinary + ".reload"
+	script := fmt.Sprintf("%[1]s cat > %[2]s && %[1]s chmod 755 %[2]s && %[1]s mv -f %[2]s %[3]s", busyboxBinary,
+		podUpload, podBinary)
+	fmt.Printf("Copying %s to %s in the pod %s...\n", binaryPath, podBinary, pod.Name)
+	if err = client.KubeClient.ExecInPod(pod, containerName, []string{busyboxBinary, "sh", "-c", script}, binary,
+		nil); err != nil {
+		return fmt.Errorf("cannot copy the binary into the pod %s: %v", pod.Name, err)
+	}
+	return nil
+}
+
+// restartDebugged function restarts the debugged process from its replaced binary, and reports whether it was
+// running, along with the breakpoints dlv couldn't set again. The restarted process is halted at its entry point.
+func restartDebugged(dlvClient *dlv.Client) (bool, []dlv.DiscardedBreakpoint, error) {
+	running, err := dlvClient.HaltIfRunning()
+	if err != nil {
+		return false, nil, err
+	}
+	fmt.Printf("Restarting %s under dlv...\n", tridentBinaryName())
+	discarded, err := dlvClient.Restart()
+	if err != nil {
+		return running, nil, fmt.Errorf("cannot restart %s: %v", tridentBinaryName(), err)
+	}
+	for _, bp := range discarded {
+		fmt.Printf("Breakpoint at %s:%d is gone from the new binary: %s\n", path.Base(bp.Breakpoint.File),
+			bp.Breakpoint.Line, bp.Reason)
+	}
+	return running, discarded, nil
+}
+
+// reload function restarts the debugged process from its replaced binary through dlv on the local port, then
+// resumes the tracepoints dlv set again, or the process itself if it was running.
+func (a *breakpointApplier) reload(localPort int) (*ReloadResult, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.disconnect()
+
+	dlvClient, err := dlv.NewClient(net.JoinHostPort(localhost, strconv.Itoa(localPort)))
+	if err != nil {
+		return nil, err
+	}
+	a.dlvClient = dlvClient
+
+	running, discarded, err := restartDebugged(dlvClient)
+	if err != nil {
+		return nil, err
+	}
+
+	breakpoints, err := dlvClient.ListBreakpoints()
+	if err != nil {
+		return nil, err
+	}
+	result := &ReloadResult{Discarded: len(discarded)}
+	tracepoints := false
+	for _, bp := range breakpoints {
+		// dlv lists its internal breakpoints, such as the one on unrecovered panics, with negative IDs.
+		if bp.ID > 0 {
+			result.Kept++
+			tracepoints = tracepoints || bp.Tracepoint || bp.TraceReturn
+		}
+	}
+
+	if tracepoints {
+		var ctx context.Context
+		ctx, a.cancel = context.WithCancel(context.Background())
+		go pumpTracepoints(ctx, dlvClient, running, printTracepointHit)
+	} else if running {
+		dlvClient.ContinueAsync()
+	}
+	return result, nil
+}
@@ -0,0 +1,332 @@
+package debug
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	stateDirName      = "trident-debug"
+	sessionsDirName   = "sessions"
+	kindDeployment    = "Deployment"
+	kindDaemonSet     = "DaemonSet"
+	stateHomeVariable = "XDG_STATE_HOME"
+
+	// SessionLive is a session whose process is still running, it reverts the workload itself when it exits.
+	SessionLive = "live"
+	// SessionOrphaned is a session whose process is gone, leaving its workload modified.
+	SessionOrphaned = "orphaned"
+	// SessionStale is a session whose workload no longer carries its annotations: it was reverted, or taken over
+	// by another session.
+	SessionStale = "stale"
+)
+
+// SessionState is the record of a debug session, written before the workload is modified, so that the workload
+// can be restored from another process when the session couldn't revert it.
+type SessionState struct {
+	// ID identifies the session, it is the name of its record.
+	ID string `json:"id"`
+	// Context is the kubeconfig context of the cluster the session runs in.
+	Context        string    `json:"context"`
+	KubeConfigPath string    `json:"kubeConfigPath,omitempty"`
+	Namespace      string    `json:"namespace"`
+	Target         string    `json:"target"`
+	NodeName       string    `json:"nodeName,omitempty"`
+	Image          string    `json:"image"`
+	Started        time.Time `json:"started"`
+	// Host and PID identify the process running the session.
+	Host string `json:"host"`
+	PID  int    `json:"pid"`
+	// Kind and Name identify the modified workload, Original is the whole workload as it was before.
+	Kind     string          `json:"kind"`
+	Name     string          `json:"name"`
+	Original json.RawMessage `json:"original"`
+	// Mutations describes the changes the session applied to the cluster.
+	Mutations []string `json:"mutations"`
+}
+
+// newSessionState function returns the record of a session about to modify the workload.
+func newSessionState(kind, name string, original any) (*SessionState, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	kubeContext, err := CurrentContext(KubeConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the current kubeconfig context: %v", err)
+	}
+	host, _ := os.Hostname()
+	return &SessionState{
+		ID:             hex.EncodeToString(id),
+		Context:        kubeContext,
+		KubeConfigPath: KubeConfigPath,
+		Namespace:      client.Namespace,
+		Target:         options.Target,
+		NodeName:       options.NodeName,
+		Image:          options.Image,
+		Started:        time.Now(),
+		Host:           host,
+		PID:            os.Getpid(),
+		Kind:           kind,
+		Name:           name,
+		Original:       content,
+	}, nil
+}
+
+// debuggerMutations function describes the changes addDebuggerToContainer applies to the container.
+func debuggerMutations(kind, name, containerName string) []string {
+	workload := fmt.Sprintf("%s %s: container %s", strings.ToLower(kind), name, containerName)
+	mutations := []string{
+		fmt.Sprintf("%s runs %s under dlv, listening on port %d", workload, targetBinary(), dlvPort),
+		fmt.Sprintf("%s runs the image %s", workload, options.Image),
+		fmt.Sprintf("%s has the SYS_PTRACE capability", workload),
+	}
+	if startsHalted() {
+		mutations = append(mutations, fmt.Sprintf("%s has no probes", workload))
+	}
+	if options.Arch != "" {
+		mutations = append(mutations, fmt.Sprintf("%s %s: pods are scheduled on %s=%s nodes only",
+			strings.ToLower(kind), name, NodeArchLabel, options.Arch))
+	}
+	return mutations
+}
+
+// save function writes the record into the state directory, replacing the previous one of the session.
+func (s *SessionState) save() error {
+	path, err := sessionStatePath(s.ID)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err = os.WriteFile(temporary, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// remove function deletes the record, once the workload is restored.
+func (s *SessionState) remove() {
+	path, err := sessionStatePath(s.ID)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Cannot remove the record of the session %s: %v\n", s.ID, err)
+	}
+}
+
+// keep function tells how to restore the workload from the record, when the session couldn't.
+func (s *SessionState) keep() {
+	fmt.Printf("The %s %s is still modified, restore it with: trident-debug restore --session %s\n",
+		strings.ToLower(s.Kind), s.Name, s.ID)
+}
+
+// sessionStateDirectory function returns the directory of the session records, $XDG_STATE_HOME/trident-debug/
+// sessions, by default in ~/.local/state.
+func sessionStateDirectory() (string, error) {
+	stateHome := os.Getenv(stateHomeVariable)
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, stateDirName, sessionsDirName), nil
+}
+
+// sessionStatePath function returns the path of the record of the session.
+func sessionStatePath(id string) (string, error) {
+	directory, err := sessionStateDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(directory, id+".json"), nil
+}
+
+// ListSessionStates function returns the records of the sessions left behind, oldest first.
+func ListSessionStates() ([]*SessionState, error) {
+	directory, err := sessionStateDirectory()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*SessionState
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		state := &SessionState{}
+		if err = json.Unmarshal(content, state); err != nil {
+			return nil, fmt.Errorf("invalid session record %s: %v", path, err)
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Started.Before(states[j].Started) })
+	return states, nil
+}
+
+// RestoreSession function reverts the workload of the session to the original one of its record, and deletes
+// the record. It only needs the record, so it works from a process other than the one of the session. The
+// kubeconfig of the session is used unless another one is given. A workload no longer annotated with the session,
+// reverted or taken over by another session, is left alone and the record is deleted as stale.
+func RestoreSession(state *SessionState, kubeConfigPath string) error {
+	clients, err := connectSession(state, kubeConfigPath)
+	if err != nil {
+		return err
+	}
+	owner, err := workloadSessionID(clients, state.Kind, state.Name)
+	if err != nil {
+		return err
+	}
+	if owner != state.ID {
+		state.remove()
+		if owner == "" {
+			return fmt.Errorf("the %s %s is no longer debugged by the session %s, its stale record is deleted",
+				strings.ToLower(state.Kind), state.Name, state.ID)
+		}
+		return fmt.Errorf("the %s %s was taken over by the session %s, the stale record of the session %s is "+
+			"deleted", strings.ToLower(state.Kind), state.Name, owner, state.ID)
+	}
+
+	switch state.Kind {
+	case kindDeployment:
+		original := &appsv1.Deployment{}
+		if err = json.Unmarshal(state.Original, original); err != nil {
+			return err
+		}
+		err = revertTridentDeployment(clients, original, state.ID)
+	case kindDaemonSet:
+		original := &appsv1.DaemonSet{}
+		if err = json.Unmarshal(state.Original, original); err != nil {
+			return err
+		}
+		err = revertTridentNode(context.Background(), clients, original, state.ID)
+	default:
+		err = fmt.Errorf("unknown workload kind %s", state.Kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	state.remove()
+	return nil
+}
+
+// SessionStatus function tells whether the session is live, orphaned or stale. A session is live while its process
+// runs, which can only be checked on the host that started it, so the sessions of other hosts are live too.
+// Otherwise the session is orphaned as long as its workload carries its annotations, and stale once they are gone.
+func SessionStatus(state *SessionState, kubeConfigPath string) (string, error) {
+	if state.ownerRunning() {
+		return SessionLive, nil
+	}
+	clients, err := connectSession(state, kubeConfigPath)
+	if err != nil {
+		return "", err
+	}
+	id, err := workloadSessionID(clients, state.Kind, state.Name)
+	if err != nil {
+		return "", err
+	}
+	if id != state.ID {
+		return SessionStale, nil
+	}
+	return SessionOrphaned, nil
+}
+
+// DiscardSession function deletes the record of the session, without touching its workload.
+func DiscardSession(state *SessionState) {
+	state.remove()
+}
+
+// ownerRunning function reports whether the process of the session may still be running. Records written before
+// the process was recorded have no owner.
+func (s *SessionState) ownerRunning() bool {
+	if s.PID == 0 {
+		return false
+	}
+	if host, err := os.Hostname(); err != nil || host != s.Host {
+		return true
+	}
+	process, err := os.FindProcess(s.PID)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// connectSession function returns clients of the cluster and namespace of the session, with the kubeconfig of the
+// session unless another one is given. The clients of the running session, if any, are left alone, as restoring
+// may happen while taking another workload over.
+func connectSession(state *SessionState, kubeConfigPath string) (*Clients, error) {
+	if kubeConfigPath == "" {
+		kubeConfigPath = state.KubeConfigPath
+	}
+	kubeContext, err := CurrentContext(kubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if kubeContext != state.Context {
+		return nil, fmt.Errorf("the session %s runs in the context %s, the current context is %s", state.ID,
+			state.Context, kubeContext)
+	}
+	return createK8sClient("", kubeConfigPath, state.Namespace)
+}
+
+// workloadSessionID function returns the ID of the session the workload is annotated with, empty when the
+// workload isn't debugged or is gone.
+func workloadSessionID(clients *Clients, kind, name string) (string, error) {
+	var meta metav1.ObjectMeta
+	switch kind {
+	case kindDeployment:
+		deployment, err := clients.KubeClient.GetDeployment().Get(context.TODO(), name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		meta = deployment.ObjectMeta
+	case kindDaemonSet:
+		daemonSet, err := clients.KubeClient.GetDaemonSet().Get(context.TODO(), name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		meta = daemonSet.ObjectMeta
+	default:
+		return "", fmt.Errorf("unknown workload kind %s", kind)
+	}
+	return meta.Annotations[SessionIDAnnotation], nil
+}
@@ -0,0 +1,261 @@
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theshashankpal/trident_debug/dlv"
+)
+
+const (
+	traceEventCall   = "call"
+	traceEventReturn = "return"
+)
+
+// TraceEvent is a function entry or exit seen by a tracepoint, as written to the trace file.
+type TraceEvent struct {
+	Time         time.Time       `json:"time"`
+	Event        string          `json:"event"`
+	GoroutineID  int64           `json:"goroutine"`
+	Function     string          `json:"function"`
+	File         string          `json:"file"`
+	Line         int             `json:"line"`
+	Arguments    []TraceVariable `json:"arguments,omitempty"`
+	ReturnValues []TraceVariable `json:"returnValues,omitempty"`
+}
+
+// TraceVariable is an argument or a return value of a traced function.
+type TraceVariable struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Tracer streams the entries and exits of the traced functions, without stopping the process for longer than it
+// takes to read their arguments and return values.
+type Tracer struct {
+	dlvClient   *dlv.Client
+	output      io.Writer
+	breakpoints []int
+	cancel      context.CancelFunc
+	done        chan struct{}
+	mutex       sync.Mutex
+}
+
+// StartTrace function sets non-stopping tracepoints on the entry and the return locations of every function
+// matching one of the patterns, regular expressions on the full function names, and streams their hits to the
+// terminal and as JSON lines to the output. It refuses to trace more than maxFunctions functions, as every
+// tracepoint hit slows the process down.
+func StartTrace(dlvClient *dlv.Client, patterns []string, maxFunctions int, output io.Writer) (*Tracer, error) {
+	tracer := &Tracer{dlvClient: dlvClient, output: output, done: make(chan struct{})}
+
+	halted, err := dlvClient.HaltIfRunning()
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		functions, err := matchFunctions(dlvClient, patterns)
+		if err != nil {
+			return err
+		}
+		if len(functions) == 0 {
+			return fmt.Errorf("no function matches %s", strings.Join(patterns, ", "))
+		}
+		if len(functions) > maxFunctions {
+			return fmt.Errorf("%d functions match %s, more than the %d allowed, please use narrower patterns",
+				len(functions), strings.Join(patterns, ", "), maxFunctions)
+		}
+
+		for _, function := range functions {
+			if err = tracer.traceFunction(function); err != nil {
+				fmt.Printf("Cannot trace %s: %v\n", function, err)
+			}
+		}
+		if len(tracer.breakpoints) == 0 {
+			return fmt.Errorf("no tracepoint could be set")
+		}
+		fmt.Printf("Tracing %d functions\n", len(functions))
+		return nil
+	}()
+	if err != nil {
+		_ = tracer.clearTracepoints()
+		if halted {
+			dlvClient.ContinueAsync()
+		}
+		return nil, err
+	}
+
+	var ctx context.Context
+	ctx, tracer.cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(tracer.done)
+		pumpTracepoints(ctx, dlvClient, halted, tracer.record)
+	}()
+
+	return tracer, nil
+}
+
+// Stop function stops the trace and removes its tracepoints, leaving the process running.
+func (t *Tracer) Stop() error {
+	t.cancel()
+	err := t.dlvClient.WithHalted(func() error {
+		// The pump returns once the halt interrupts its wait.
+		<-t.done
+		return t.clearTracepoints()
+	})
+	return err
+}
+
+// matchFunctions function returns the functions matching any of the patterns, without duplicates.
+func matchFunctions(dlvClient *dlv.Client, patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var functions []string
+	for _, pattern := range patterns {
+		matches, err := dlvClient.ListFunctions(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list the functions matching %s: %v", pattern, err)
+		}
+		for _, function := range matches {
+			if !seen[function] {
+				seen[function] = true
+				functions = append(functions, function)
+			}
+		}
+	}
+	return functions, nil
+}
+
+// traceFunction function sets a tracepoint on the entry of the function, and one on each of its return locations.
+func (t *Tracer) traceFunction(function string) error {
+	entry, err := t.dlvClient.CreateBreakpoint(&dlv.Breakpoint{
+		FunctionName: function,
+		Line:         -1,
+		Tracepoint:   true,
+		LoadArgs:     &dlv.DefaultLoadConfig,
+	}, "")
+	if err != nil {
+		return err
+	}
+	t.breakpoints = append(t.breakpoints, entry.ID)
+
+	addresses, err := t.dlvClient.FunctionReturnLocations(function)
+	if err != nil {
+		return fmt.Errorf("only its calls are traced, cannot find its returns: %v", err)
+	}
+	for _, address := range addresses {
+		exit, err := t.dlvClient.CreateBreakpoint(&dlv.Breakpoint{
+			Addr:        address,
+			Line:        -1,
+			TraceReturn: true,
+			LoadArgs:    &dlv.DefaultLoadConfig,
+		}, "")
+		if err != nil {
+			return fmt.Errorf("cannot trace its return at %#x: %v", address, err)
+		}
+		t.breakpoints = append(t.breakpoints, exit.ID)
+	}
+	return nil
+}
+
+// clearTracepoints function removes the tracepoints set by the tracer.
+func (t *Tracer) clearTracepoints() error {
+	var failed int
+	for _, id := range t.breakpoints {
+		if _, err := t.dlvClient.ClearBreakpoint(id); err != nil {
+			failed++
+		}
+	}
+	t.breakpoints = nil
+	if failed > 0 {
+		return fmt.Errorf("%d tracepoints couldn't be removed", failed)
+	}
+	return nil
+}
+
+// record function prints a tracepoint hit and writes it to the trace file.
+func (t *Tracer) record(thread *dlv.Thread) {
+	event := TraceEvent{
+		Time:        time.Now(),
+		Event:       traceEventCall,
+		GoroutineID: thread.GoroutineID,
+		Function:    "?",
+		File:        thread.File,
+		Line:        thread.Line,
+	}
+	if thread.Function != nil {
+		event.Function = thread.Function.Name
+	}
+	if thread.Breakpoint.TraceReturn {
+		event.Event = traceEventReturn
+		event.ReturnValues = traceVariables(thread.ReturnValues)
+	} else if thread.BreakpointInfo != nil {
+		event.Arguments = traceVariables(callArguments(thread.BreakpointInfo.Arguments))
+	}
+
+	printTraceEvent(&event)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	line, err := json.Marshal(&event)
+	if err == nil {
+		_, err = t.output.Write(append(line, '\n'))
+	}
+	if err != nil {
+		fmt.Println("Cannot write the trace event:", err)
+	}
+}
+
+// traceVariables function formats the variables of a tracepoint hit.
+func traceVariables(variables []dlv.Variable) []TraceVariable {
+	formatted := make([]TraceVariable, 0, len(variables))
+	for i := range variables {
+		formatted = append(formatted, TraceVariable{
+			Name:  variables[i].Name,
+			Type:  variables[i].Type,
+			Value: dlv.FormatVariable(&variables[i]),
+		})
+	}
+	return formatted
+}
+
+// callArguments function drops the unnamed return values, which are listed among the arguments of a function but
+// aren't set yet at its entry.
+func callArguments(arguments []dlv.Variable) []dlv.Variable {
+	filtered := make([]dlv.Variable, 0, len(arguments))
+	for i := range arguments {
+		if !strings.HasPrefix(arguments[i].Name, "~r") {
+			filtered = append(filtered, arguments[i])
+		}
+	}
+	return filtered
+}
+
+// printTraceEvent function prints a trace event on a single line.
+func printTraceEvent(event *TraceEvent) {
+	join := func(variables []TraceVariable, withNames bool) string {
+		values := make([]string, 0, len(variables))
+		for _, variable := range variables {
+			if withNames {
+				values = append(values, variable.Name+"="+variable.Value)
+			} else {
+				values = append(values, variable.Value)
+			}
+		}
+		return strings.Join(values, ", ")
+	}
+
+	timestamp := event.Time.Format("15:04:05.000")
+	if event.Event == traceEventReturn {
+		fmt.Printf("%s goroutine %d << %s => (%s)\n", timestamp, event.GoroutineID, event.Function,
+			join(event.ReturnValues, false))
+		return
+	}
+	fmt.Printf("%s goroutine %d >> %s(%s) %s:%d\n", timestamp, event.GoroutineID, event.Function,
+		join(event.Arguments, true), event.File, event.Line)
+}
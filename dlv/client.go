@@ -0,0 +1,368 @@
+package dlv
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	rpcService  = "RPCServer."
+)
+
+// Client is a client of dlv's JSON-RPC API (version 2), as served by `dlv --headless --api-version=2`.
+type Client struct {
+	address string
+	client  *rpc.Client
+}
+
+// NewClient connects to the dlv server listening at the address.
+func NewClient(address string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to dlv at %s: %v", address, err)
+	}
+	return &Client{address: address, client: jsonrpc.NewClient(conn)}, nil
+}
+
+// Address returns the address of the dlv server.
+func (c *Client) Address() string {
+	return c.address
+}
+
+// Close closes the connection to the dlv server. The debugged process is left as it is.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+func (c *Client) call(method string, args, reply interface{}) error {
+	return c.client.Call(rpcService+method, args, reply)
+}
+
+// State returns the current debugger state. It doesn't wait for a running process to stop.
+func (c *Client) State() (*DebuggerState, error) {
+	var out struct{ State *DebuggerState }
+	err := c.call("State", struct{ NonBlocking bool }{true}, &out)
+	return out.State, err
+}
+
+// WaitForStop waits until the process is stopped and returns the debugger state then.
+func (c *Client) WaitForStop() (*DebuggerState, error) {
+	var out struct{ State *DebuggerState }
+	err := c.call("State", struct{ NonBlocking bool }{false}, &out)
+	return out.State, err
+}
+
+// StoppedAtTracepointsOnly reports whether the process is stopped only because threads hit tracepoints, in
+// which case it is meant to be resumed right away.
+func StoppedAtTracepointsOnly(state *DebuggerState) bool {
+	atTracepoint := false
+	for _, thread := range state.Threads {
+		if thread.Breakpoint == nil {
+			continue
+		}
+		if !thread.Breakpoint.Tracepoint && !thread.Breakpoint.TraceReturn {
+			return false
+		}
+		atTracepoint = true
+	}
+	return atTracepoint
+}
+
+// command runs a command changing the execution state and returns the state once the command is done.
+func (c *Client) command(cmd debuggerCommand) (*DebuggerState, error) {
+	var out struct{ State DebuggerState }
+	if err := c.call("Command", cmd, &out); err != nil {
+		return nil, err
+	}
+	return &out.State, nil
+}
+
+// Continue resumes the process and returns the state once it stops again.
+func (c *Client) Continue() (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandContinue, ReturnInfoLoadConfig: &DefaultLoadConfig})
+}
+
+// ContinueAsync resumes the process without waiting for it to stop again.
+func (c *Client) ContinueAsync() {
+	var out struct{ State DebuggerState }
+	c.client.Go(rpcService+"Command", debuggerCommand{Name: commandContinue, ReturnInfoLoadConfig: &DefaultLoadConfig},
+		&out, nil)
+}
+
+// Next steps over to the next source line.
+func (c *Client) Next() (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandNext, ReturnInfoLoadConfig: &DefaultLoadConfig})
+}
+
+// Step steps into the next source line.
+func (c *Client) Step() (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandStep, ReturnInfoLoadConfig: &DefaultLoadConfig})
+}
+
+// StepOut steps out of the current function.
+func (c *Client) StepOut() (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandStepOut, ReturnInfoLoadConfig: &DefaultLoadConfig})
+}
+
+// Halt suspends the process.
+func (c *Client) Halt() (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandHalt})
+}
+
+// SwitchGoroutine selects the goroutine commands apply to.
+func (c *Client) SwitchGoroutine(goroutineID int64) (*DebuggerState, error) {
+	return c.command(debuggerCommand{Name: commandSwitchGoroutine, GoroutineID: goroutineID})
+}
+
+// WithHalted runs fn with the process halted. A running process is halted first and resumed afterwards,
+// so that fn can use the calls delve refuses while the process runs.
+func (c *Client) WithHalted(fn func() error) error {
+	halted, err := c.HaltIfRunning()
+	if err != nil {
+		return err
+	}
+	if halted {
+		defer c.ContinueAsync()
+	}
+	return fn()
+}
+
+// HaltIfRunning halts the process unless it is already stopped, and reports whether it had to. The caller is
+// then in charge of resuming it.
+func (c *Client) HaltIfRunning() (bool, error) {
+	state, err := c.State()
+	if err != nil {
+		return false, err
+	}
+	if !state.Running {
+		return false, nil
+	}
+	if _, err = c.Halt(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Restart kills the process and starts it again from its binary, which may have been replaced in the meantime,
+// with the same arguments. The breakpoints are set again, those whose location is gone are returned. A running
+// process is halted first, and the restarted one is stopped at its entry point.
+func (c *Client) Restart() ([]DiscardedBreakpoint, error) {
+	if _, err := c.HaltIfRunning(); err != nil {
+		return nil, err
+	}
+	var out struct{ DiscardedBreakpoints []DiscardedBreakpoint }
+	err := c.call("Restart", struct{ Position string }{""}, &out)
+	return out.DiscardedBreakpoints, err
+}
+
+// Detach detaches dlv from the process, which keeps running unless kill is set, and stops the dlv server. A
+// running process is halted first, as dlv only detaches from a stopped one.
+func (c *Client) Detach(kill bool) error {
+	if _, err := c.HaltIfRunning(); err != nil {
+		return err
+	}
+	var out struct{}
+	return c.call("Detach", struct{ Kill bool }{kill}, &out)
+}
+
+// CreateBreakpoint sets a breakpoint described by bp at the location expression, which may be empty when bp
+// holds the location itself.
+func (c *Client) CreateBreakpoint(bp *Breakpoint, location string) (*Breakpoint, error) {
+	in := struct {
+		Breakpoint Breakpoint
+		LocExpr    string
+	}{Breakpoint: *bp, LocExpr: location}
+	var out struct{ Breakpoint Breakpoint }
+	if err := c.call("CreateBreakpoint", in, &out); err != nil {
+		return nil, err
+	}
+	return &out.Breakpoint, nil
+}
+
+// ListBreakpoints returns the breakpoints set by users.
+func (c *Client) ListBreakpoints() ([]*Breakpoint, error) {
+	var out struct{ Breakpoints []*Breakpoint }
+	err := c.call("ListBreakpoints", struct{ All bool }{false}, &out)
+	return out.Breakpoints, err
+}
+
+// ClearBreakpoint removes the breakpoint with the ID.
+func (c *Client) ClearBreakpoint(id int) (*Breakpoint, error) {
+	in := struct {
+		Id   int
+		Name string
+	}{Id: id}
+	var out struct{ Breakpoint *Breakpoint }
+	err := c.call("ClearBreakpoint", in, &out)
+	return out.Breakpoint, err
+}
+
+// ListFunctions returns the names of the functions of the process matching the regular expression.
+func (c *Client) ListFunctions(filter string) ([]string, error) {
+	in := struct {
+		Filter      string
+		FollowCalls int
+	}{Filter: filter}
+	var out struct{ Funcs []string }
+	err := c.call("ListFunctions", in, &out)
+	return out.Funcs, err
+}
+
+// FindLocation returns the locations the location expression resolves to, e.g. the file and line of a function.
+func (c *Client) FindLocation(location string) ([]Location, error) {
+	in := struct {
+		Scope EvalScope
+		Loc   string
+	}{Scope: EvalScope{GoroutineID: -1}, Loc: location}
+	var out struct{ Locations []Location }
+	err := c.call("FindLocation", in, &out)
+	return out.Locations, err
+}
+
+// FunctionReturnLocations returns the addresses at which the function returns.
+func (c *Client) FunctionReturnLocations(function string) ([]uint64, error) {
+	in := struct{ FnName string }{FnName: function}
+	var out struct{ Addrs []uint64 }
+	err := c.call("FunctionReturnLocations", in, &out)
+	return out.Addrs, err
+}
+
+// DumpStart starts writing a core dump of the process to the destination path, on the dlv server's side.
+// The process has to stay halted until the dump is done.
+func (c *Client) DumpStart(destination string) (*DumpState, error) {
+	in := struct{ Destination string }{Destination: destination}
+	var out struct{ State DumpState }
+	err := c.call("DumpStart", in, &out)
+	return &out.State, err
+}
+
+// DumpWait waits up to wait for the core dump in progress to finish, and returns its state.
+func (c *Client) DumpWait(wait time.Duration) (*DumpState, error) {
+	in := struct{ Wait int }{Wait: int(wait.Milliseconds())}
+	var out struct{ State DumpState }
+	err := c.call("DumpWait", in, &out)
+	return &out.State, err
+}
+
+// DumpCancel cancels the core dump in progress.
+func (c *Client) DumpCancel() error {
+	var out struct{}
+	return c.call("DumpCancel", struct{}{}, &out)
+}
+
+// ListGoroutines returns count goroutines starting from the start-th one, along with the index to continue
+// from, which is 0 when there are no more goroutines.
+func (c *Client) ListGoroutines(start, count int) ([]*Goroutine, int, error) {
+	in := struct {
+		Start int
+		Count int
+	}{Start: start, Count: count}
+	var out struct {
+		Goroutines []*Goroutine
+		Nextg      int
+	}
+	err := c.call("ListGoroutines", in, &out)
+	return out.Goroutines, out.Nextg, err
+}
+
+// Stacktrace returns up to depth frames of the stack of the goroutine.
+func (c *Client) Stacktrace(goroutineID int64, depth int, cfg *LoadConfig) ([]Stackframe, error) {
+	in := struct {
+		Id    int64
+		Depth int
+		Full  bool
+		Cfg   *LoadConfig
+	}{Id: goroutineID, Depth: depth, Full: cfg != nil, Cfg: cfg}
+	var out struct{ Locations []Stackframe }
+	err := c.call("Stacktrace", in, &out)
+	return out.Locations, err
+}
+
+// Stacktraces returns up to depth frames of the stacks of the goroutines, in the same order. The requests are
+// pipelined on the connection rather than sent one after the other, dlv answers them in turn without waiting for
+// the client in between.
+func (c *Client) Stacktraces(goroutineIDs []int64, depth int) ([][]Stackframe, error) {
+	type stacktraceOut struct{ Locations []Stackframe }
+	calls := make([]*rpc.Call, len(goroutineIDs))
+	for i, id := range goroutineIDs {
+		in := struct {
+			Id    int64
+			Depth int
+		}{Id: id, Depth: depth}
+		calls[i] = c.client.Go(rpcService+"Stacktrace", in, &stacktraceOut{}, nil)
+	}
+
+	stacks := make([][]Stackframe, len(goroutineIDs))
+	var err error
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			if err == nil {
+				err = fmt.Errorf("cannot read the stack of goroutine %d: %v", goroutineIDs[i], call.Error)
+			}
+			continue
+		}
+		stacks[i] = call.Reply.(*stacktraceOut).Locations
+	}
+	return stacks, err
+}
+
+// Eval evaluates the expression in the scope of the goroutine's frame.
+func (c *Client) Eval(goroutineID int64, frame int, expr string) (*Variable, error) {
+	in := struct {
+		Scope EvalScope
+		Expr  string
+		Cfg   *LoadConfig
+	}{Scope: EvalScope{GoroutineID: goroutineID, Frame: frame}, Expr: expr, Cfg: &DefaultLoadConfig}
+	var out struct{ Variable *Variable }
+	err := c.call("Eval", in, &out)
+	return out.Variable, err
+}
+
+// FormatVariable returns a single line representation of the variable.
+func FormatVariable(v *Variable) string {
+	if v.Unreadable != "" {
+		return fmt.Sprintf("(unreadable %s)", v.Unreadable)
+	}
+
+	switch v.Kind {
+	case reflect.String:
+		return strconv.Quote(v.Value)
+	case reflect.Ptr:
+		if len(v.Children) == 0 || v.Children[0].Addr == 0 {
+			return v.Type + " nil"
+		}
+		return "*" + FormatVariable(&v.Children[0])
+	case reflect.Map:
+		entries := make([]string, 0, len(v.Children)/2)
+		for i := 0; i+1 < len(v.Children); i += 2 {
+			entries = append(entries, FormatVariable(&v.Children[i])+": "+FormatVariable(&v.Children[i+1]))
+		}
+		return v.Type + " [" + strings.Join(entries, ", ") + "]"
+	}
+
+	if len(v.Children) == 0 {
+		if v.Value == "" {
+			return v.Type + " nil"
+		}
+		return v.Value
+	}
+
+	children := make([]string, 0, len(v.Children))
+	for i := range v.Children {
+		child := &v.Children[i]
+		if child.Name != "" {
+			children = append(children, child.Name+": "+FormatVariable(child))
+		} else {
+			children = append(children, FormatVariable(child))
+		}
+	}
+	return v.Type + " {" + strings.Join(children, ", ") + "}"
+}
@@ -0,0 +1,187 @@
+package dlv
+
+import "reflect"
+
+// The types below mirror the subset of delve's service/api types used by the client. Field names and JSON keys
+// have to match delve's, as they travel as is over its JSON-RPC API (version 2).
+
+// Breakpoint addresses a set of locations at which the process execution may be suspended.
+type Breakpoint struct {
+	ID            int               `json:"id"`
+	Name          string            `json:"name"`
+	Addr          uint64            `json:"addr"`
+	Addrs         []uint64          `json:"addrs"`
+	File          string            `json:"file"`
+	Line          int               `json:"line"`
+	FunctionName  string            `json:"functionName,omitempty"`
+	Cond          string            `json:"Cond"`
+	HitCond       string            `json:"hitCond"`
+	Tracepoint    bool              `json:"continue"`
+	TraceReturn   bool              `json:"traceReturn,omitempty"`
+	Goroutine     bool              `json:"goroutine"`
+	Stacktrace    int               `json:"stacktrace"`
+	Variables     []string          `json:"variables,omitempty"`
+	LoadArgs      *LoadConfig       `json:"LoadArgs"`
+	LoadLocals    *LoadConfig       `json:"LoadLocals"`
+	HitCount      map[string]uint64 `json:"hitCount"`
+	TotalHitCount uint64            `json:"totalHitCount"`
+	Disabled      bool              `json:"Disabled"`
+}
+
+// BreakpointInfo contains information about the current breakpoint.
+type BreakpointInfo struct {
+	Stacktrace []Stackframe `json:"stacktrace,omitempty"`
+	Goroutine  *Goroutine   `json:"goroutine,omitempty"`
+	Variables  []Variable   `json:"variables,omitempty"`
+	Arguments  []Variable   `json:"arguments,omitempty"`
+	Locals     []Variable   `json:"locals,omitempty"`
+}
+
+// DebuggerState represents the current context of the debugger.
+type DebuggerState struct {
+	Pid               int        `json:"Pid"`
+	Running           bool       `json:"Running"`
+	CoreDumping       bool       `json:"CoreDumping"`
+	CurrentThread     *Thread    `json:"currentThread,omitempty"`
+	SelectedGoroutine *Goroutine `json:"currentGoroutine,omitempty"`
+	Threads           []*Thread  `json:"Threads"`
+	NextInProgress    bool       `json:"NextInProgress"`
+	Exited            bool       `json:"exited"`
+	ExitStatus        int        `json:"exitStatus"`
+}
+
+// Thread is a thread within the debugged process.
+type Thread struct {
+	ID             int             `json:"id"`
+	PC             uint64          `json:"pc"`
+	File           string          `json:"file"`
+	Line           int             `json:"line"`
+	Function       *Function       `json:"function,omitempty"`
+	GoroutineID    int64           `json:"goroutineID"`
+	Breakpoint     *Breakpoint     `json:"breakPoint,omitempty"`
+	BreakpointInfo *BreakpointInfo `json:"breakPointInfo,omitempty"`
+	ReturnValues   []Variable      `json:"ReturnValues"`
+}
+
+// Function represents thread-scoped function information.
+type Function struct {
+	Name      string `json:"name"`
+	Value     uint64 `json:"value"`
+	Optimized bool   `json:"optimized"`
+}
+
+// Location holds program location information.
+type Location struct {
+	PC       uint64    `json:"pc"`
+	File     string    `json:"file"`
+	Line     int       `json:"line"`
+	Function *Function `json:"function,omitempty"`
+	PCs      []uint64  `json:"pcs,omitempty"`
+}
+
+// Stackframe describes one frame in a stack trace.
+type Stackframe struct {
+	Location
+	Locals    []Variable `json:"Locals"`
+	Arguments []Variable `json:"Arguments"`
+	Bottom    bool       `json:"Bottom,omitempty"`
+	Err       string     `json:"Err"`
+}
+
+// Goroutine represents the information relevant to Delve from the runtime's internal G structure.
+type Goroutine struct {
+	ID             int64             `json:"id"`
+	CurrentLoc     Location          `json:"currentLoc"`
+	UserCurrentLoc Location          `json:"userCurrentLoc"`
+	GoStatementLoc Location          `json:"goStatementLoc"`
+	StartLoc       Location          `json:"startLoc"`
+	ThreadID       int               `json:"threadID"`
+	Status         uint64            `json:"status"`
+	WaitSince      int64             `json:"waitSince"`
+	WaitReason     int64             `json:"waitReason"`
+	Unreadable     string            `json:"Unreadable"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// Variable describes a variable.
+type Variable struct {
+	Name       string       `json:"name"`
+	Addr       uint64       `json:"addr"`
+	Type       string       `json:"type"`
+	RealType   string       `json:"realType"`
+	Kind       reflect.Kind `json:"kind"`
+	Value      string       `json:"value"`
+	Len        int64        `json:"len"`
+	Cap        int64        `json:"cap"`
+	Children   []Variable   `json:"children"`
+	Unreadable string       `json:"unreadable"`
+}
+
+// LoadConfig describes how to load values from the target's memory.
+type LoadConfig struct {
+	FollowPointers     bool `json:"FollowPointers"`
+	MaxVariableRecurse int  `json:"MaxVariableRecurse"`
+	MaxStringLen       int  `json:"MaxStringLen"`
+	MaxArrayValues     int  `json:"MaxArrayValues"`
+	MaxStructFields    int  `json:"MaxStructFields"`
+}
+
+// EvalScope is the scope a command gets evaluated in.
+type EvalScope struct {
+	GoroutineID  int64 `json:"GoroutineID"`
+	Frame        int   `json:"Frame"`
+	DeferredCall int   `json:"DeferredCall"`
+}
+
+// DumpState describes the state of a core dump in progress.
+type DumpState struct {
+	Dumping      bool   `json:"Dumping"`
+	AllDone      bool   `json:"AllDone"`
+	ThreadsDone  int    `json:"ThreadsDone"`
+	ThreadsTotal int    `json:"ThreadsTotal"`
+	MemDone      uint64 `json:"MemDone"`
+	MemTotal     uint64 `json:"MemTotal"`
+	Err          string `json:"Err"`
+}
+
+// DiscardedBreakpoint is a breakpoint that could not be set again after a restart.
+type DiscardedBreakpoint struct {
+	Breakpoint *Breakpoint `json:"breakpoint"`
+	Reason     string      `json:"reason"`
+}
+
+// debuggerCommand is a command which changes the debugger's execution state.
+type debuggerCommand struct {
+	Name                 string      `json:"name"`
+	GoroutineID          int64       `json:"goroutineID,omitempty"`
+	ReturnInfoLoadConfig *LoadConfig `json:"ReturnInfoLoadConfig,omitempty"`
+}
+
+// Names of the delve commands changing the execution state.
+const (
+	commandContinue        = "continue"
+	commandNext            = "next"
+	commandStep            = "step"
+	commandStepOut         = "stepOut"
+	commandHalt            = "halt"
+	commandSwitchGoroutine = "switchGoroutine"
+)
+
+// Goroutine status values, as found in the runtime.
+const (
+	GoroutineIdle     = 0
+	GoroutineRunnable = 1
+	GoroutineRunning  = 2
+	GoroutineSyscall  = 3
+	GoroutineWaiting  = 4
+	GoroutineDead     = 6
+)
+
+// DefaultLoadConfig is the load configuration used to print variables.
+var DefaultLoadConfig = LoadConfig{
+	FollowPointers:     true,
+	MaxVariableRecurse: 1,
+	MaxStringLen:       64,
+	MaxArrayValues:     64,
+	MaxStructFields:    -1,
+}